@@ -0,0 +1,515 @@
+package mocks
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// MinPartSize is the smallest S3 allows any but the last part of a multipart
+// upload to be.
+const MinPartSize = 5 * 1024 * 1024
+
+// S3Object is an object stored in the S3 mock.
+type S3Object struct {
+	Body          []byte
+	ContentType   string
+	Metadata      map[string]string
+	Tagging       string
+	ETag          string
+	VersionID     string
+	StorageClass  string
+	ACL           string
+	CacheControl  string
+	Encoding      string
+	SSE           string
+	SSEKMSKeyID   string
+	LastModified  time.Time
+	PartsUploaded int
+}
+
+type multipartUpload struct {
+	bucket string
+	key    string
+	object S3Object
+	parts  map[int64][]byte
+}
+
+// S3 is an in-memory mock of the S3 API. It is a real *s3.S3 client whose
+// requests are handled in memory instead of being sent, so it can be given to
+// s3manager.NewUploaderWithClient. It supports PutObject, HeadObject,
+// GetObject (with ranges), DeleteObject and the multipart upload calls; any
+// other call fails with a NotImplemented error.
+type S3 struct {
+	*s3.S3
+
+	// Fault, if set, is called before each call with the name of the call,
+	// e.g. "PutObject" or "UploadPart", and the bucket and key. If it
+	// returns an error, the call fails with that error instead.
+	Fault func(op, bucket, key string) error
+	// Versioned makes the mock give each object a version ID.
+	Versioned bool
+
+	mu      sync.Mutex
+	buckets map[string]bool
+	objects map[string]*S3Object
+	uploads map[string]*multipartUpload
+	calls   map[string]int
+	nextID  int
+}
+
+// NewS3 returns an empty S3 mock with buckets. Calls for other buckets fail
+// with NoSuchBucket.
+func NewS3(buckets ...string) *S3 {
+	m := &S3{
+		buckets: make(map[string]bool),
+		objects: make(map[string]*S3Object),
+		uploads: make(map[string]*multipartUpload),
+		calls:   make(map[string]int),
+	}
+	for _, b := range buckets {
+		m.buckets[b] = true
+	}
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:           aws.String("us-east-1"),
+		Endpoint:         aws.String("http://s3.mock"),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("mock", "mock", ""),
+		MaxRetries:       aws.Int(0),
+	}))
+	m.S3 = s3.New(sess)
+	m.Handlers.Sign.Clear()
+	m.Handlers.Send.Clear()
+	m.Handlers.Send.PushBack(m.handle)
+	return m
+}
+
+// Put stores an object directly, e.g. to set up a test.
+func (m *S3) Put(bucket, key string, body []byte, metadata map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.store(bucket, key, &S3Object{Body: body, Metadata: metadata, ETag: etag(body)})
+}
+
+// Object returns a copy of the object at bucket/key, if there is one.
+func (m *S3) Object(bucket, key string) (S3Object, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o, ok := m.objects[bucket+"/"+key]
+	if !ok {
+		return S3Object{}, false
+	}
+	return *o, true
+}
+
+// Keys returns the keys of the objects in bucket, sorted.
+func (m *S3) Keys(bucket string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var keys []string
+	for k := range m.objects {
+		if strings.HasPrefix(k, bucket+"/") {
+			keys = append(keys, strings.TrimPrefix(k, bucket+"/"))
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Uploads returns the number of multipart uploads which have been started but
+// neither completed nor aborted.
+func (m *S3) Uploads() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.uploads)
+}
+
+// Calls returns how many times op has been called, including calls that
+// failed.
+func (m *S3) Calls(op string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.calls[op]
+}
+
+func etag(body []byte) string {
+	sum := md5.Sum(body)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func s3Error(code string, status int, message string) error {
+	return awserr.NewRequestFailure(awserr.New(code, message, nil), status, "mock")
+}
+
+// store saves o at bucket/key. The caller must hold mu.
+func (m *S3) store(bucket, key string, o *S3Object) {
+	if m.Versioned {
+		m.nextID++
+		o.VersionID = strconv.Itoa(m.nextID)
+	}
+	o.LastModified = time.Now()
+	m.objects[bucket+"/"+key] = o
+}
+
+// handle carries out r in place of sending it.
+func (m *S3) handle(r *request.Request) {
+	// Some calls add their own handlers when they are built, so the response
+	// handlers are cleared here rather than on the client.
+	r.Handlers.UnmarshalMeta.Clear()
+	r.Handlers.ValidateResponse.Clear()
+	r.Handlers.Unmarshal.Clear()
+	r.Handlers.UnmarshalError.Clear()
+	r.HTTPResponse = &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(&bytes.Buffer{}),
+	}
+	bucket, key := target(r.Params)
+
+	m.mu.Lock()
+	m.calls[r.Operation.Name]++
+	fault := m.Fault
+	m.mu.Unlock()
+	if fault != nil {
+		if r.Error = fault(r.Operation.Name, bucket, key); r.Error != nil {
+			return
+		}
+	}
+
+	var body []byte
+	if r.Body != nil {
+		if _, err := r.Body.Seek(r.BodyStart, io.SeekStart); err != nil {
+			r.Error = err
+			return
+		}
+		if body, r.Error = ioutil.ReadAll(r.Body); r.Error != nil {
+			return
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.buckets[bucket] {
+		r.Error = s3Error(s3.ErrCodeNoSuchBucket, http.StatusNotFound, "The specified bucket does not exist")
+		return
+	}
+	switch in := r.Params.(type) {
+	case *s3.PutObjectInput:
+		r.Error = m.putObject(in, body, r.Data.(*s3.PutObjectOutput))
+	case *s3.HeadObjectInput:
+		r.Error = m.headObject(in, r.Data.(*s3.HeadObjectOutput))
+	case *s3.GetObjectInput:
+		r.Error = m.getObject(in, r.Data.(*s3.GetObjectOutput))
+	case *s3.DeleteObjectInput:
+		delete(m.objects, bucket+"/"+key)
+	case *s3.CreateMultipartUploadInput:
+		r.Error = m.createMultipartUpload(in, r.Data.(*s3.CreateMultipartUploadOutput))
+	case *s3.UploadPartInput:
+		r.Error = m.uploadPart(in, body, r.Data.(*s3.UploadPartOutput))
+	case *s3.CompleteMultipartUploadInput:
+		r.Error = m.completeMultipartUpload(in, r.Data.(*s3.CompleteMultipartUploadOutput))
+	case *s3.AbortMultipartUploadInput:
+		if _, ok := m.uploads[aws.StringValue(in.UploadId)]; !ok {
+			r.Error = s3Error(s3.ErrCodeNoSuchUpload, http.StatusNotFound, "The specified upload does not exist")
+		}
+		delete(m.uploads, aws.StringValue(in.UploadId))
+	case *s3.ListMultipartUploadsInput:
+		m.listMultipartUploads(in, r.Data.(*s3.ListMultipartUploadsOutput))
+	default:
+		r.Error = s3Error("NotImplemented", http.StatusNotImplemented, r.Operation.Name+" is not supported by the mock")
+	}
+}
+
+// target returns the bucket and key params is for.
+func target(params interface{}) (string, string) {
+	var bucket, key *string
+	switch in := params.(type) {
+	case *s3.PutObjectInput:
+		bucket, key = in.Bucket, in.Key
+	case *s3.HeadObjectInput:
+		bucket, key = in.Bucket, in.Key
+	case *s3.GetObjectInput:
+		bucket, key = in.Bucket, in.Key
+	case *s3.DeleteObjectInput:
+		bucket, key = in.Bucket, in.Key
+	case *s3.CreateMultipartUploadInput:
+		bucket, key = in.Bucket, in.Key
+	case *s3.UploadPartInput:
+		bucket, key = in.Bucket, in.Key
+	case *s3.CompleteMultipartUploadInput:
+		bucket, key = in.Bucket, in.Key
+	case *s3.AbortMultipartUploadInput:
+		bucket, key = in.Bucket, in.Key
+	case *s3.ListMultipartUploadsInput:
+		bucket = in.Bucket
+	}
+	return aws.StringValue(bucket), aws.StringValue(key)
+}
+
+func checkMD5(contentMD5 *string, body []byte) error {
+	if contentMD5 == nil {
+		return nil
+	}
+	sum := md5.Sum(body)
+	if aws.StringValue(contentMD5) != base64.StdEncoding.EncodeToString(sum[:]) {
+		return s3Error("BadDigest", http.StatusBadRequest, "The Content-MD5 you specified did not match what we received")
+	}
+	return nil
+}
+
+func (m *S3) putObject(in *s3.PutObjectInput, body []byte, out *s3.PutObjectOutput) error {
+	if err := checkMD5(in.ContentMD5, body); err != nil {
+		return err
+	}
+	o := &S3Object{
+		Body:         body,
+		ContentType:  aws.StringValue(in.ContentType),
+		Metadata:     aws.StringValueMap(in.Metadata),
+		Tagging:      aws.StringValue(in.Tagging),
+		ETag:         etag(body),
+		StorageClass: aws.StringValue(in.StorageClass),
+		ACL:          aws.StringValue(in.ACL),
+		CacheControl: aws.StringValue(in.CacheControl),
+		Encoding:     aws.StringValue(in.ContentEncoding),
+		SSE:          aws.StringValue(in.ServerSideEncryption),
+		SSEKMSKeyID:  aws.StringValue(in.SSEKMSKeyId),
+	}
+	m.store(aws.StringValue(in.Bucket), aws.StringValue(in.Key), o)
+	out.ETag = aws.String(o.ETag)
+	if o.VersionID != "" {
+		out.VersionId = aws.String(o.VersionID)
+	}
+	return nil
+}
+
+// canonicalMetadata returns metadata with its keys canonicalized as HTTP
+// headers, as the SDK returns them.
+func canonicalMetadata(metadata map[string]string) map[string]*string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	canonical := make(map[string]*string, len(metadata))
+	for k, v := range metadata {
+		canonical[http.CanonicalHeaderKey(k)] = aws.String(v)
+	}
+	return canonical
+}
+
+func (m *S3) object(bucket, key *string) (*S3Object, error) {
+	o, ok := m.objects[aws.StringValue(bucket)+"/"+aws.StringValue(key)]
+	if !ok {
+		return nil, s3Error(s3.ErrCodeNoSuchKey, http.StatusNotFound, "The specified key does not exist.")
+	}
+	return o, nil
+}
+
+func (m *S3) headObject(in *s3.HeadObjectInput, out *s3.HeadObjectOutput) error {
+	o, err := m.object(in.Bucket, in.Key)
+	if err != nil {
+		// HEAD responses have no body, so there's no error code either.
+		return s3Error("NotFound", http.StatusNotFound, "Not Found")
+	}
+	out.ContentLength = aws.Int64(int64(len(o.Body)))
+	out.ContentType = aws.String(o.ContentType)
+	out.ETag = aws.String(o.ETag)
+	out.LastModified = aws.Time(o.LastModified)
+	out.Metadata = canonicalMetadata(o.Metadata)
+	if o.VersionID != "" {
+		out.VersionId = aws.String(o.VersionID)
+	}
+	if o.Encoding != "" {
+		out.ContentEncoding = aws.String(o.Encoding)
+	}
+	return nil
+}
+
+func (m *S3) getObject(in *s3.GetObjectInput, out *s3.GetObjectOutput) error {
+	o, err := m.object(in.Bucket, in.Key)
+	if err != nil {
+		return err
+	}
+	body := o.Body
+	if in.Range != nil {
+		start, end, err := parseRange(aws.StringValue(in.Range), int64(len(body)))
+		if err != nil {
+			return err
+		}
+		out.ContentRange = aws.String(fmt.Sprintf("bytes %d-%d/%d", start, end, len(body)))
+		body = body[start : end+1]
+	}
+	out.Body = ioutil.NopCloser(bytes.NewReader(body))
+	out.ContentLength = aws.Int64(int64(len(body)))
+	out.ContentType = aws.String(o.ContentType)
+	out.ETag = aws.String(o.ETag)
+	out.LastModified = aws.Time(o.LastModified)
+	out.Metadata = canonicalMetadata(o.Metadata)
+	if o.VersionID != "" {
+		out.VersionId = aws.String(o.VersionID)
+	}
+	if o.Encoding != "" {
+		out.ContentEncoding = aws.String(o.Encoding)
+	}
+	return nil
+}
+
+// parseRange parses a single range of the form bytes=start-end, bytes=start-
+// or bytes=-suffix for an object of size bytes.
+func parseRange(r string, size int64) (int64, int64, error) {
+	invalid := s3Error("InvalidRange", http.StatusRequestedRangeNotSatisfiable, "The requested range is not satisfiable")
+	spec := strings.TrimPrefix(r, "bytes=")
+	parts := strings.Split(spec, "-")
+	if spec == r || len(parts) != 2 {
+		return 0, 0, invalid
+	}
+	var start, end int64
+	var err error
+	switch {
+	case parts[0] == "":
+		n, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, invalid
+		}
+		if n > size {
+			n = size
+		}
+		start, end = size-n, size-1
+	default:
+		if start, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+			return 0, 0, invalid
+		}
+		end = size - 1
+		if parts[1] != "" {
+			if end, err = strconv.ParseInt(parts[1], 10, 64); err != nil || end < start {
+				return 0, 0, invalid
+			}
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return 0, 0, invalid
+	}
+	return start, end, nil
+}
+
+func (m *S3) createMultipartUpload(in *s3.CreateMultipartUploadInput, out *s3.CreateMultipartUploadOutput) error {
+	m.nextID++
+	id := fmt.Sprintf("upload-%d", m.nextID)
+	m.uploads[id] = &multipartUpload{
+		bucket: aws.StringValue(in.Bucket),
+		key:    aws.StringValue(in.Key),
+		object: S3Object{
+			ContentType:  aws.StringValue(in.ContentType),
+			Metadata:     aws.StringValueMap(in.Metadata),
+			Tagging:      aws.StringValue(in.Tagging),
+			StorageClass: aws.StringValue(in.StorageClass),
+			ACL:          aws.StringValue(in.ACL),
+			CacheControl: aws.StringValue(in.CacheControl),
+			Encoding:     aws.StringValue(in.ContentEncoding),
+			SSE:          aws.StringValue(in.ServerSideEncryption),
+			SSEKMSKeyID:  aws.StringValue(in.SSEKMSKeyId),
+		},
+		parts: make(map[int64][]byte),
+	}
+	out.Bucket, out.Key, out.UploadId = in.Bucket, in.Key, aws.String(id)
+	return nil
+}
+
+func (m *S3) upload(id *string) (*multipartUpload, error) {
+	u, ok := m.uploads[aws.StringValue(id)]
+	if !ok {
+		return nil, s3Error(s3.ErrCodeNoSuchUpload, http.StatusNotFound, "The specified upload does not exist")
+	}
+	return u, nil
+}
+
+func (m *S3) uploadPart(in *s3.UploadPartInput, body []byte, out *s3.UploadPartOutput) error {
+	u, err := m.upload(in.UploadId)
+	if err != nil {
+		return err
+	}
+	if err = checkMD5(in.ContentMD5, body); err != nil {
+		return err
+	}
+	u.parts[aws.Int64Value(in.PartNumber)] = body
+	out.ETag = aws.String(etag(body))
+	return nil
+}
+
+func (m *S3) completeMultipartUpload(in *s3.CompleteMultipartUploadInput, out *s3.CompleteMultipartUploadOutput) error {
+	u, err := m.upload(in.UploadId)
+	if err != nil {
+		return err
+	}
+	if in.MultipartUpload == nil || len(in.MultipartUpload.Parts) == 0 {
+		return s3Error("MalformedXML", http.StatusBadRequest, "The XML you provided was not well-formed")
+	}
+	var body []byte
+	sums := md5.New()
+	last := int64(0)
+	for i, p := range in.MultipartUpload.Parts {
+		n := aws.Int64Value(p.PartNumber)
+		data, ok := u.parts[n]
+		if !ok || aws.StringValue(p.ETag) != etag(data) {
+			return s3Error("InvalidPart", http.StatusBadRequest, fmt.Sprintf("Part %d could not be found", n))
+		}
+		if n <= last {
+			return s3Error("InvalidPartOrder", http.StatusBadRequest, "The list of parts was not in ascending order")
+		}
+		if i < len(in.MultipartUpload.Parts)-1 && len(data) < MinPartSize {
+			return s3Error("EntityTooSmall", http.StatusBadRequest, "Your proposed upload is smaller than the minimum allowed size")
+		}
+		last = n
+		body = append(body, data...)
+		sum := md5.Sum(data)
+		sums.Write(sum[:])
+	}
+
+	o := u.object
+	o.Body = body
+	o.ETag = fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(sums.Sum(nil)), len(in.MultipartUpload.Parts))
+	o.PartsUploaded = len(in.MultipartUpload.Parts)
+	m.store(u.bucket, u.key, &o)
+	delete(m.uploads, aws.StringValue(in.UploadId))
+
+	out.Bucket, out.Key, out.ETag = in.Bucket, in.Key, aws.String(o.ETag)
+	if o.VersionID != "" {
+		out.VersionId = aws.String(o.VersionID)
+	}
+	return nil
+}
+
+func (m *S3) listMultipartUploads(in *s3.ListMultipartUploadsInput, out *s3.ListMultipartUploadsOutput) {
+	var ids []string
+	for id, u := range m.uploads {
+		if u.bucket == aws.StringValue(in.Bucket) && strings.HasPrefix(u.key, aws.StringValue(in.Prefix)) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	out.Bucket = in.Bucket
+	for _, id := range ids {
+		out.Uploads = append(out.Uploads, &s3.MultipartUpload{
+			Key:      aws.String(m.uploads[id].key),
+			UploadId: aws.String(id),
+		})
+	}
+}
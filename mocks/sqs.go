@@ -1,5 +1,5 @@
 /*
-Package mocks provides SQS interface mocks for testing.
+Package mocks provides SQS and S3 interface mocks for testing.
 */
 package mocks
 
@@ -40,3 +40,8 @@ func (s *SQS) SendMessage(in *sqs.SendMessageInput) (*sqs.SendMessageOutput, err
 		MD5OfMessageBody: aws.String(hash),
 	}, nil
 }
+
+// LastSent returns the body of the last message sent with SendMessage.
+func (s *SQS) LastSent() string {
+	return s.lastSent
+}
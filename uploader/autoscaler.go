@@ -0,0 +1,130 @@
+package uploader
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/twitchscience/aws_utils/logger"
+)
+
+// DefaultAutoscaleInterval is how often the autoscaler resizes the pool if
+// AutoscaleConfig.Interval isn't set.
+const DefaultAutoscaleInterval = 10 * time.Second
+
+// AutoscaleConfig controls how WithAutoscaler resizes a pool. Every Interval
+// the pool is resized by one worker:
+//
+//   - down, if the average upload latency over the interval was above
+//     MaxLatency, since the uploads are contending for bandwidth and more of
+//     them would only slow each other down;
+//   - up, if more than QueueDepth requests are queued;
+//   - down, if nothing is queued and some workers were idle for the whole
+//     interval;
+//
+// always staying between MinWorkers and MaxWorkers.
+type AutoscaleConfig struct {
+	MinWorkers int
+	MaxWorkers int
+	// Interval defaults to DefaultAutoscaleInterval.
+	Interval   time.Duration
+	QueueDepth int
+	// MaxLatency of zero means latency is ignored.
+	MaxLatency time.Duration
+}
+
+// WithAutoscaler resizes the pool as its load changes, according to cfg.
+// The pool starts with the number of workers given to StartUploaderPool.
+func WithAutoscaler(cfg AutoscaleConfig) PoolOption {
+	return func(p *UploaderPool) {
+		if cfg.MinWorkers < 1 {
+			cfg.MinWorkers = 1
+		}
+		if cfg.MaxWorkers < cfg.MinWorkers {
+			cfg.MaxWorkers = cfg.MinWorkers
+		}
+		if cfg.Interval <= 0 {
+			cfg.Interval = DefaultAutoscaleInterval
+		}
+		p.scaler = &autoscaler{cfg: cfg}
+	}
+}
+
+// autoscaler tracks a pool's load between resizes. Its methods do nothing on
+// a nil autoscaler, so the pool can call them whether or not it has one.
+type autoscaler struct {
+	cfg AutoscaleConfig
+
+	// These are reset every interval.
+	peakInFlight int64
+	uploads      int64
+	latency      int64
+}
+
+// started records that an upload started with inFlight uploads in progress.
+func (a *autoscaler) started(inFlight int64) {
+	if a == nil {
+		return
+	}
+	for {
+		peak := atomic.LoadInt64(&a.peakInFlight)
+		if inFlight <= peak || atomic.CompareAndSwapInt64(&a.peakInFlight, peak, inFlight) {
+			return
+		}
+	}
+}
+
+// finished records that an upload succeeded after latency.
+func (a *autoscaler) finished(latency time.Duration) {
+	if a == nil {
+		return
+	}
+	atomic.AddInt64(&a.uploads, 1)
+	atomic.AddInt64(&a.latency, int64(latency))
+}
+
+// run resizes p every interval until p is closed.
+func (a *autoscaler) run(p *UploaderPool) {
+	ticker := time.NewTicker(a.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			size := p.Size()
+			target := a.target(size, p.sched.queueDepth(), p.inFlightCount())
+			if target == size {
+				continue
+			}
+			if err := p.Resize(target); err != nil && err != ErrPoolClosed {
+				logger.WithError(err).WithField("workers", target).Error("Failed to resize uploader pool")
+			}
+		case <-p.closing:
+			return
+		}
+	}
+}
+
+// target returns the number of workers the pool should have, given its
+// current size, queue depth and number of uploads in flight, and starts a new
+// interval.
+func (a *autoscaler) target(size, depth int, inFlight int64) int {
+	peak := atomic.SwapInt64(&a.peakInFlight, inFlight)
+	uploads := atomic.SwapInt64(&a.uploads, 0)
+	latency := atomic.SwapInt64(&a.latency, 0)
+
+	target := size
+	switch {
+	case a.cfg.MaxLatency > 0 && uploads > 0 && time.Duration(latency/uploads) > a.cfg.MaxLatency:
+		target--
+	case depth > a.cfg.QueueDepth:
+		target++
+	case depth == 0 && peak < int64(size):
+		target--
+	}
+	if target < a.cfg.MinWorkers {
+		target = a.cfg.MinWorkers
+	}
+	if target > a.cfg.MaxWorkers {
+		target = a.cfg.MaxWorkers
+	}
+	return target
+}
@@ -0,0 +1,64 @@
+package uploader
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAutoscalerTarget(t *testing.T) {
+	cfg := AutoscaleConfig{
+		MinWorkers: 2,
+		MaxWorkers: 4,
+		QueueDepth: 5,
+		MaxLatency: time.Second,
+	}
+	for _, tc := range []struct {
+		name      string
+		size      int
+		depth     int
+		peak      int64
+		latencies []time.Duration
+		expected  int
+	}{
+		{name: "steady", size: 3, depth: 5, peak: 3, expected: 3},
+		{name: "backlog", size: 3, depth: 6, peak: 3, expected: 4},
+		{name: "backlog at max", size: 4, depth: 100, peak: 4, expected: 4},
+		{name: "idle", size: 3, depth: 0, peak: 1, expected: 2},
+		{name: "idle at min", size: 2, depth: 0, peak: 0, expected: 2},
+		{name: "busy with empty queue", size: 3, depth: 0, peak: 3, expected: 3},
+		{
+			name:      "slow uploads",
+			size:      3,
+			depth:     10,
+			peak:      3,
+			latencies: []time.Duration{time.Second, 2 * time.Second},
+			expected:  2,
+		},
+		{
+			name:      "fast uploads",
+			size:      3,
+			depth:     10,
+			peak:      3,
+			latencies: []time.Duration{time.Second, 500 * time.Millisecond},
+			expected:  4,
+		},
+	} {
+		a := &autoscaler{cfg: cfg}
+		a.started(tc.peak)
+		for _, latency := range tc.latencies {
+			a.finished(latency)
+		}
+		if target := a.target(tc.size, tc.depth, 0); target != tc.expected {
+			t.Errorf("%s: expected %d workers but got %d", tc.name, tc.expected, target)
+		}
+	}
+}
+
+func TestWithAutoscalerDefaults(t *testing.T) {
+	p := &UploaderPool{}
+	WithAutoscaler(AutoscaleConfig{MaxWorkers: -1})(p)
+	expected := AutoscaleConfig{MinWorkers: 1, MaxWorkers: 1, Interval: DefaultAutoscaleInterval}
+	if p.scaler.cfg != expected {
+		t.Errorf("expected %+v but got %+v", expected, p.scaler.cfg)
+	}
+}
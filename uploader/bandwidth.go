@@ -0,0 +1,259 @@
+package uploader
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// throttleChunk is the most that is read between waits on a
+// BandwidthLimiter, so the rate stays smooth however large the reads are.
+const throttleChunk = 64 * 1024
+
+// BandwidthLimiter limits the combined rate at which uploaders read the files
+// they upload, and so the rate they send to S3. Share one between the
+// uploaders of a Factory with WithBandwidthLimiter, and between several
+// factories, and so pools, by passing it to each.
+//
+// The limit is a token bucket which allows bursts of up to a second's worth
+// of bytes. Each byte of a file is only counted once per upload attempt,
+// since the AWS SDK reads request bodies twice: once to sign them, and again
+// to send them. A BandwidthLimiter is safe for concurrent use.
+type BandwidthLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+
+	throttled int64
+}
+
+// NewBandwidthLimiter returns a BandwidthLimiter which allows bytesPerSecond.
+// A limit of zero or less means no limit.
+func NewBandwidthLimiter(bytesPerSecond int64) *BandwidthLimiter {
+	l := &BandwidthLimiter{}
+	l.SetLimit(bytesPerSecond)
+	return l
+}
+
+// SetLimit changes the limit to bytesPerSecond. Uploads in progress pick up
+// the new limit on their next read.
+func (l *BandwidthLimiter) SetLimit(bytesPerSecond int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	unlimited := l.rate <= 0
+	l.rate = float64(bytesPerSecond)
+	if unlimited || l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+}
+
+// Limit returns the limit in bytes per second, or zero if there is none.
+func (l *BandwidthLimiter) Limit() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	return int64(l.rate)
+}
+
+// Throttled returns the total time reads have been held up by the limiter.
+func (l *BandwidthLimiter) Throttled() time.Duration {
+	return time.Duration(atomic.LoadInt64(&l.throttled))
+}
+
+// refill adds the tokens earned since the last refill. The caller must hold
+// mu.
+func (l *BandwidthLimiter) refill(now time.Time) {
+	if l.rate > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.rate {
+			l.tokens = l.rate
+		}
+	}
+	l.last = now
+}
+
+// wait takes n bytes from the bucket, sleeping until they would have been
+// available, and returns how long it slept. It returns early with ctx.Err()
+// if ctx is done first.
+func (l *BandwidthLimiter) wait(ctx context.Context, n int) (time.Duration, error) {
+	l.mu.Lock()
+	l.refill(time.Now())
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return 0, nil
+	}
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	if delay <= 0 {
+		return 0, nil
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	atomic.AddInt64(&l.throttled, int64(delay))
+	return delay, nil
+}
+
+// limit returns r throttled by l, adding the time spent waiting to
+// throttled. A file's ReadAt and Seek methods are kept so s3manager can still
+// read its parts concurrently without buffering them. A nil limiter returns r
+// as it is.
+func (l *BandwidthLimiter) limit(ctx context.Context, r io.Reader, throttled *int64) io.Reader {
+	if l == nil {
+		return r
+	}
+	tr := &throttledReader{r: r, limiter: l, ctx: ctx, throttled: throttled}
+	if f, ok := r.(readSeekerAt); ok {
+		pos, _ := f.Seek(0, io.SeekCurrent)
+		return &throttledFile{throttledReader: tr, f: f, pos: pos}
+	}
+	return tr
+}
+
+type readSeekerAt interface {
+	io.ReadSeeker
+	io.ReaderAt
+}
+
+type throttledReader struct {
+	r         io.Reader
+	limiter   *BandwidthLimiter
+	ctx       context.Context
+	throttled *int64
+}
+
+func (t *throttledReader) wait(n int) error {
+	d, err := t.limiter.wait(t.ctx, n)
+	atomic.AddInt64(t.throttled, int64(d))
+	return err
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := t.r.Read(p)
+	if werr := t.wait(n); werr != nil {
+		return n, werr
+	}
+	return n, err
+}
+
+// throttledFile only waits for bytes it hasn't read before, so reading a part
+// again after seeking back, as the SDK's signer does, isn't counted twice.
+type throttledFile struct {
+	*throttledReader
+	f readSeekerAt
+
+	mu sync.Mutex
+	// pos is the offset of the next Read.
+	pos int64
+	// read holds the sorted, disjoint ranges of offsets read so far.
+	read []span
+}
+
+// span is the range of offsets [start, end).
+type span struct {
+	start, end int64
+}
+
+// unread records that the n bytes at off have been read, and returns how many
+// of them hadn't been read before.
+func (t *throttledFile) unread(off int64, n int) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	start, end := off, off+int64(n)
+	fresh := end - start
+	merged := span{start, end}
+	spans := t.read[:0:0]
+	for _, s := range t.read {
+		if s.end < start || s.start > end {
+			spans = append(spans, s)
+			continue
+		}
+		if lo, hi := max64(s.start, start), min64(s.end, end); hi > lo {
+			fresh -= hi - lo
+		}
+		merged = span{min64(merged.start, s.start), max64(merged.end, s.end)}
+	}
+	spans = append(spans, merged)
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].start < spans[j].start
+	})
+	t.read = spans
+	return int(fresh)
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func (t *throttledFile) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := t.f.Read(p)
+	t.mu.Lock()
+	off := t.pos
+	t.pos += int64(n)
+	t.mu.Unlock()
+	if werr := t.wait(t.unread(off, n)); werr != nil {
+		return n, werr
+	}
+	return n, err
+}
+
+func (t *throttledFile) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+	for read < len(p) {
+		end := read + throttleChunk
+		if end > len(p) {
+			end = len(p)
+		}
+		n, err := t.f.ReadAt(p[read:end], off+int64(read))
+		if werr := t.wait(t.unread(off+int64(read), n)); werr != nil {
+			return read + n, werr
+		}
+		read += n
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+func (t *throttledFile) Seek(offset int64, whence int) (int64, error) {
+	pos, err := t.f.Seek(offset, whence)
+	if err == nil {
+		t.mu.Lock()
+		t.pos = pos
+		t.mu.Unlock()
+	}
+	return pos, err
+}
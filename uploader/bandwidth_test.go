@@ -0,0 +1,106 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/twitchscience/aws_utils/mocks"
+)
+
+func TestBandwidthLimiter(t *testing.T) {
+	l := NewBandwidthLimiter(1 << 20)
+	if limit := l.Limit(); limit != 1<<20 {
+		t.Errorf("expected limit %d but got %d", 1<<20, limit)
+	}
+
+	// The first second's worth is allowed straight away, the rest at the
+	// limit.
+	var throttled int64
+	start := time.Now()
+	n, err := io.Copy(ioutil.Discard, l.limit(context.Background(), bytes.NewReader(make([]byte, 5<<18)), &throttled))
+	if err != nil || n != 5<<18 {
+		t.Fatalf("expected to read %d bytes, got %d and %v", 5<<18, n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("expected reading to take at least 200ms but took %v", elapsed)
+	}
+	if throttled == 0 || time.Duration(throttled) != l.Throttled() {
+		t.Errorf("expected throttled time to match the limiter's %v but got %v", l.Throttled(), time.Duration(throttled))
+	}
+
+	l.SetLimit(0)
+	if limit := l.Limit(); limit != 0 {
+		t.Errorf("expected no limit but got %d", limit)
+	}
+	throttled = 0
+	if _, err = io.Copy(ioutil.Discard, l.limit(context.Background(), bytes.NewReader(make([]byte, 5<<20)), &throttled)); err != nil || throttled != 0 {
+		t.Errorf("expected unthrottled read but got %v throttled and %v", time.Duration(throttled), err)
+	}
+}
+
+func TestBandwidthLimiterCanceled(t *testing.T) {
+	l := NewBandwidthLimiter(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	var throttled int64
+	_, err := ioutil.ReadAll(l.limit(ctx, strings.NewReader("too much data"), &throttled))
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected %v but got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestUploaderBandwidthLimiter(t *testing.T) {
+	filename := writeTempFile(t, strings.Repeat("x", 3000))
+	defer os.Remove(filename)
+
+	s3Uploader := &recordingS3Uploader{}
+	l := NewBandwidthLimiter(10000)
+	u := NewFactory("bucket", &simpleNameGenerator{prefix: "logs"}, s3Uploader,
+		WithBandwidthLimiter(l), WithDisposer(Keep)).NewUploader()
+	for i := 0; i < 5; i++ {
+		receipt, err := u.Upload(&UploadRequest{Filename: filename, FileType: Text})
+		if err != nil {
+			t.Fatalf("upload failed: %v", err)
+		}
+		if i >= 4 && receipt.Throttled == 0 {
+			t.Errorf("expected upload %d to be throttled", i)
+		}
+	}
+	// Files keep their ReadAt method so s3manager doesn't buffer them.
+	if _, ok := s3Uploader.inputs[0].Body.(io.ReaderAt); !ok {
+		t.Errorf("expected the body to be an io.ReaderAt but got %T", s3Uploader.inputs[0].Body)
+	}
+}
+
+func TestUploaderBandwidthLimiterSigned(t *testing.T) {
+	filename := writeTempFile(t, strings.Repeat("x", 20000))
+	defer os.Remove(filename)
+
+	// The mock doesn't sign requests, but the signer reads each body before
+	// it is sent, and only the bytes sent should count towards the limit.
+	bucket := mocks.NewS3("bucket")
+	bucket.Handlers.Sign.PushBackNamed(v4.SignRequestHandler)
+	l := NewBandwidthLimiter(10000)
+	u := NewFactory("bucket", &simpleNameGenerator{prefix: "logs"}, s3manager.NewUploaderWithClient(bucket),
+		WithBandwidthLimiter(l), WithDisposer(Keep)).NewUploader()
+	receipt, err := u.Upload(&UploadRequest{Filename: filename, FileType: Text})
+	if err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	// The first 10000 bytes are allowed straight away, and the rest take a
+	// second.
+	if receipt.Throttled < 500*time.Millisecond || receipt.Throttled > 1500*time.Millisecond {
+		t.Errorf("expected about a second of throttling but got %v", receipt.Throttled)
+	}
+	if object, ok := bucket.Object("bucket", "logs/"+filename); !ok || len(object.Body) != 20000 {
+		t.Errorf("expected the whole file to be uploaded")
+	}
+}
@@ -0,0 +1,103 @@
+package uploader
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// ChecksumAlgorithm is a set of checksums for the uploader to compute.
+type ChecksumAlgorithm int
+
+const (
+	ChecksumMD5 ChecksumAlgorithm = 1 << iota
+	ChecksumSHA256
+
+	// ChecksumNone disables checksums.
+	ChecksumNone ChecksumAlgorithm = 0
+)
+
+// Checksums are also stored as user metadata on the object under these keys
+// (as lowercase hex), since S3 doesn't keep them for multipart uploads.
+const (
+	MD5MetadataKey    = "md5"
+	SHA256MetadataKey = "sha256"
+)
+
+// checksummer computes checksums of everything written to it.
+type checksummer struct {
+	md5    hash.Hash
+	sha256 hash.Hash
+	w      io.Writer
+	size   int64
+}
+
+func newChecksummer(algorithms ChecksumAlgorithm) *checksummer {
+	c := &checksummer{}
+	var writers []io.Writer
+	if algorithms&ChecksumMD5 != 0 {
+		c.md5 = md5.New()
+		writers = append(writers, c.md5)
+	}
+	if algorithms&ChecksumSHA256 != 0 {
+		c.sha256 = sha256.New()
+		writers = append(writers, c.sha256)
+	}
+	c.w = io.MultiWriter(writers...)
+	return c
+}
+
+func (c *checksummer) Write(p []byte) (int, error) {
+	c.size += int64(len(p))
+	return c.w.Write(p)
+}
+
+// MD5 returns the hex MD5, or "" if it wasn't computed.
+func (c *checksummer) MD5() string {
+	if c.md5 == nil {
+		return ""
+	}
+	return hex.EncodeToString(c.md5.Sum(nil))
+}
+
+// SHA256 returns the hex SHA-256, or "" if it wasn't computed.
+func (c *checksummer) SHA256() string {
+	if c.sha256 == nil {
+		return ""
+	}
+	return hex.EncodeToString(c.sha256.Sum(nil))
+}
+
+// hexToBase64 converts a hex checksum to the base64 form S3 headers use.
+func hexToBase64(h string) string {
+	b, _ := hex.DecodeString(h)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// ChecksumMismatchError is returned when the ETag S3 reports for an upload
+// doesn't match the MD5 of the data that was sent.
+type ChecksumMismatchError struct {
+	Bucket string
+	Key    string
+	MD5    string
+	ETag   string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("checksum mismatch for s3://%s/%s: sent md5 %s, got ETag %s", e.Bucket, e.Key, e.MD5, e.ETag)
+}
+
+// etagMatches reports whether etag is consistent with the hex MD5 of the
+// object. The ETags of multipart uploads aren't MD5s and always match.
+func etagMatches(etag, md5hex string) bool {
+	etag = strings.Trim(etag, `"`)
+	if md5hex == "" || etag == "" || strings.Contains(etag, "-") {
+		return true
+	}
+	return strings.EqualFold(etag, md5hex)
+}
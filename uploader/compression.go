@@ -0,0 +1,151 @@
+package uploader
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is an encoding the uploader applies to files as it streams
+// them to S3.
+type Compression string
+
+const (
+	// NoCompression uploads files as they are. Set it on an UploadRequest
+	// to override a Factory's compression.
+	NoCompression   Compression = "none"
+	GzipCompression Compression = "gzip"
+	ZstdCompression Compression = "zstd"
+)
+
+// WithCompression compresses each file as it is uploaded, without writing a
+// compressed copy to disk. The key name is generated for the filename with
+// the compression's extension (e.g. ".gz") appended, the Content-Type is set
+// to match the compression, and the Content-Encoding to "gzip" or "zstd"
+// unless WithContentEncoding says otherwise. It panics if c isn't one of the
+// Compression constants, since every upload would fail.
+//
+// Since the compressed data isn't known until it is streamed, its checksums
+// can't be sent for S3 to validate or stored in the object's metadata; they
+// are still checked against the ETag of single-part uploads and reported in
+// the UploadReceipt. For the same reason compressed uploads can't be used
+// with WithSkipIdentical, and fail if they are.
+func WithCompression(c Compression) FactoryOption {
+	if err := c.validate(); err != nil {
+		panic(err)
+	}
+	return func(f *factory) {
+		f.compression = c
+	}
+}
+
+// validate returns an error if c isn't a known compression.
+func (c Compression) validate() error {
+	switch c {
+	case "", NoCompression, GzipCompression, ZstdCompression:
+		return nil
+	}
+	return fmt.Errorf("unknown compression %q", c)
+}
+
+func (c Compression) enabled() bool {
+	return c != "" && c != NoCompression
+}
+
+// contentEncoding is the Content-Encoding of data compressed with c.
+func (c Compression) contentEncoding() string {
+	if !c.enabled() {
+		return ""
+	}
+	return string(c)
+}
+
+func (c Compression) extension() string {
+	switch c {
+	case GzipCompression:
+		return ".gz"
+	case ZstdCompression:
+		return ".zst"
+	}
+	return ""
+}
+
+func (c Compression) fileType() FileTypeHeader {
+	switch c {
+	case GzipCompression:
+		return Gzip
+	case ZstdCompression:
+		return Zstd
+	}
+	return ""
+}
+
+func (c Compression) newWriter(w io.Writer) (io.WriteCloser, error) {
+	switch c {
+	case GzipCompression:
+		return gzip.NewWriter(w), nil
+	case ZstdCompression:
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unknown compression %q", c)
+}
+
+// newReader returns a reader of r decompressed with c.
+func (c Compression) newReader(r io.Reader) (io.ReadCloser, error) {
+	switch c {
+	case GzipCompression:
+		return gzip.NewReader(r)
+	case ZstdCompression:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", c)
+}
+
+// compressionOf returns the compression an object with the given
+// Content-Type was uploaded with, or NoCompression.
+func compressionOf(contentType FileTypeHeader) Compression {
+	switch contentType {
+	case Gzip:
+		return GzipCompression
+	case Zstd:
+		return ZstdCompression
+	}
+	return NoCompression
+}
+
+// compress returns a reader of r compressed with c. Everything read is also
+// written to sums. Closing the reader stops the compression and waits until r
+// is no longer being read.
+func (c Compression) compress(r io.Reader, sums io.Writer) io.ReadCloser {
+	pr, pw := io.Pipe()
+	cr := &compressingReader{PipeReader: pr, done: make(chan struct{})}
+	go func() {
+		defer close(cr.done)
+		zw, err := c.newWriter(io.MultiWriter(pw, sums))
+		if err == nil {
+			_, err = io.Copy(zw, r)
+			if cerr := zw.Close(); err == nil {
+				err = cerr
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	return cr
+}
+
+type compressingReader struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+func (cr *compressingReader) Close() error {
+	err := cr.PipeReader.Close()
+	<-cr.done
+	return err
+}
@@ -0,0 +1,165 @@
+package uploader
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Disposer decides what happens to a local file once its upload has finished.
+// uploadErr is nil if the upload succeeded.
+type Disposer interface {
+	Dispose(req *UploadRequest, uploadErr error) error
+}
+
+// DisposerFunc adapts an ordinary function to the Disposer interface.
+type DisposerFunc func(req *UploadRequest, uploadErr error) error
+
+// Dispose calls f(req, uploadErr).
+func (f DisposerFunc) Dispose(req *UploadRequest, uploadErr error) error {
+	return f(req, uploadErr)
+}
+
+var (
+	// RemoveAlways removes the file whether or not the upload succeeded, so a
+	// long S3 outage can't fill up the disk. This is the default.
+	RemoveAlways Disposer = DisposerFunc(func(req *UploadRequest, _ error) error {
+		return os.Remove(req.Filename)
+	})
+
+	// RemoveOnSuccess removes the file after a successful upload and leaves it
+	// in place otherwise. Use it with a RequeueErrorNotifier to retry failed
+	// uploads later.
+	RemoveOnSuccess Disposer = DisposerFunc(func(req *UploadRequest, uploadErr error) error {
+		if uploadErr != nil {
+			return nil
+		}
+		return os.Remove(req.Filename)
+	})
+
+	// Keep never touches the file.
+	Keep Disposer = DisposerFunc(func(*UploadRequest, error) error {
+		return nil
+	})
+)
+
+// DirectoryDisposer moves files into directories instead of deleting them.
+// Successfully uploaded files are moved to ArchiveDir, or removed if it is
+// empty. Files which failed to upload are moved to QuarantineDir, or left in
+// place if it is empty. If QuarantineMaxBytes is positive, the oldest files
+// in QuarantineDir are deleted whenever its total size exceeds that limit.
+type DirectoryDisposer struct {
+	ArchiveDir         string
+	QuarantineDir      string
+	QuarantineMaxBytes int64
+
+	// mu serializes quarantining so concurrent workers agree on the cap.
+	mu sync.Mutex
+}
+
+// Dispose implements Disposer.
+func (d *DirectoryDisposer) Dispose(req *UploadRequest, uploadErr error) error {
+	if uploadErr == nil {
+		if d.ArchiveDir == "" {
+			return os.Remove(req.Filename)
+		}
+		_, err := moveToDir(req.Filename, d.ArchiveDir)
+		return err
+	}
+	if d.QuarantineDir == "" {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, err := moveToDir(req.Filename, d.QuarantineDir); err != nil {
+		return err
+	}
+	if d.QuarantineMaxBytes > 0 {
+		return trimDir(d.QuarantineDir, d.QuarantineMaxBytes)
+	}
+	return nil
+}
+
+// moveToDir moves filename into dir, keeping its base name unless a file by
+// that name is already there. It returns the new path.
+func moveToDir(filename, dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	dest := filepath.Join(dir, filepath.Base(filename))
+	if _, err := os.Stat(dest); err == nil {
+		dest = fmt.Sprintf("%s.%d", dest, time.Now().UnixNano())
+	}
+	if err := os.Rename(filename, dest); err != nil {
+		// Rename fails across filesystems, so fall back to copying.
+		if cerr := copyFile(filename, dest); cerr != nil {
+			return "", err
+		}
+		if err = os.Remove(filename); err != nil {
+			return "", err
+		}
+	}
+	return dest, nil
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode())
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dest)
+		return err
+	}
+	if err = out.Close(); err != nil {
+		os.Remove(dest)
+		return err
+	}
+	return os.Chtimes(dest, info.ModTime(), info.ModTime())
+}
+
+// trimDir deletes the oldest regular files in dir until their total size is
+// at most maxBytes.
+func trimDir(dir string, maxBytes int64) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var files []os.FileInfo
+	var total int64
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			files = append(files, info)
+			total += info.Size()
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, info := range files {
+		if total <= maxBytes {
+			break
+		}
+		if err = os.Remove(filepath.Join(dir, info.Name())); err != nil {
+			return err
+		}
+		total -= info.Size()
+	}
+	return nil
+}
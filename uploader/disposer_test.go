@@ -0,0 +1,92 @@
+package uploader
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestFile(t *testing.T, dir, name string, size int, modTime time.Time) string {
+	fn := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(fn, make([]byte, size), 0644); err != nil {
+		t.Fatalf("Error writing %s: %v", fn, err)
+	}
+	if err := os.Chtimes(fn, modTime, modTime); err != nil {
+		t.Fatalf("Error setting times on %s: %v", fn, err)
+	}
+	return fn
+}
+
+func exists(fn string) bool {
+	_, err := os.Stat(fn)
+	return err == nil
+}
+
+func TestRemoveOnSuccess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disposer_test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	failed := writeTestFile(t, dir, "failed", 1, time.Now())
+	if err = RemoveOnSuccess.Dispose(&UploadRequest{Filename: failed}, errors.New("")); err != nil {
+		t.Errorf("Unexpected error disposing of failed upload: %v", err)
+	}
+	if !exists(failed) {
+		t.Errorf("Expected %s to be kept after failed upload", failed)
+	}
+
+	succeeded := writeTestFile(t, dir, "succeeded", 1, time.Now())
+	if err = RemoveOnSuccess.Dispose(&UploadRequest{Filename: succeeded}, nil); err != nil {
+		t.Errorf("Unexpected error disposing of successful upload: %v", err)
+	}
+	if exists(succeeded) {
+		t.Errorf("Expected %s to be removed after successful upload", succeeded)
+	}
+}
+
+func TestDirectoryDisposer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disposer_test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := &DirectoryDisposer{
+		ArchiveDir:         filepath.Join(dir, "archive"),
+		QuarantineDir:      filepath.Join(dir, "quarantine"),
+		QuarantineMaxBytes: 25,
+	}
+
+	fn := writeTestFile(t, dir, "succeeded", 10, time.Now())
+	if err = d.Dispose(&UploadRequest{Filename: fn}, nil); err != nil {
+		t.Errorf("Unexpected error archiving %s: %v", fn, err)
+	}
+	if exists(fn) || !exists(filepath.Join(d.ArchiveDir, "succeeded")) {
+		t.Errorf("Expected %s to be moved to %s", fn, d.ArchiveDir)
+	}
+
+	// Each file is older than the next, so the cap should evict in order.
+	start := time.Now().Add(-time.Hour)
+	for i, name := range []string{"failed1", "failed2", "failed3"} {
+		fn = writeTestFile(t, dir, name, 10, start.Add(time.Duration(i)*time.Minute))
+		if err = d.Dispose(&UploadRequest{Filename: fn}, errors.New("")); err != nil {
+			t.Errorf("Unexpected error quarantining %s: %v", fn, err)
+		}
+		if exists(fn) {
+			t.Errorf("Expected %s to be moved to %s", fn, d.QuarantineDir)
+		}
+	}
+	if exists(filepath.Join(d.QuarantineDir, "failed1")) {
+		t.Errorf("Expected oldest quarantined file to be deleted once over the cap")
+	}
+	for _, name := range []string{"failed2", "failed3"} {
+		if !exists(filepath.Join(d.QuarantineDir, name)) {
+			t.Errorf("Expected %s to be quarantined", name)
+		}
+	}
+}
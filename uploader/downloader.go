@@ -0,0 +1,348 @@
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
+)
+
+// DownloadRequest is an object to download to a local file.
+type DownloadRequest struct {
+	Bucket string
+	Key    string
+	// VersionID, if set, is the version of the object to download.
+	VersionID string
+	// Filename is where the object is saved. It is downloaded to a temporary
+	// file in the same directory, which is renamed to Filename once it is
+	// complete and verified, so Filename never holds part of an object.
+	Filename string
+	// MD5 and SHA256, if set, are the hex checksums the object must have,
+	// e.g. from an UploadReceipt. Otherwise the checksums in the object's
+	// metadata are used, or failing that its ETag if it is an MD5.
+	MD5    string
+	SHA256 string
+	// Timeout bounds the time spent downloading this request, including
+	// retries. Zero means no limit beyond the submitting context.
+	Timeout time.Duration
+	// Retry, if set, overrides fields of the factory's retry policy for
+	// this request.
+	Retry *RetryPolicy
+	ctx   context.Context
+}
+
+// NewDownloadRequest returns a request to download the object msg describes
+// to filename, checked against the checksums in msg.
+func NewDownloadRequest(msg *ReceiptMessage, filename string) *DownloadRequest {
+	return &DownloadRequest{
+		Bucket:    msg.Bucket,
+		Key:       msg.Key,
+		VersionID: msg.VersionID,
+		Filename:  filename,
+		MD5:       msg.MD5,
+		SHA256:    msg.SHA256,
+	}
+}
+
+// DownloadReceipt describes a finished download.
+type DownloadReceipt struct {
+	Bucket    string
+	Key       string
+	VersionID string
+	Path      string
+	// Size is the number of bytes downloaded, and RawSize the size of the
+	// local file. They differ if the object was decompressed.
+	Size    int64
+	RawSize int64
+	// MD5 and SHA256 are the hex checksums of the downloaded bytes.
+	MD5         string
+	SHA256      string
+	ETag        string
+	ContentType FileTypeHeader
+	// Metadata is the object's metadata, with lowercased keys.
+	Metadata map[string]string
+	// Attempts is how many times the download was tried.
+	Attempts int
+}
+
+// DownloadChecksumError is returned when a downloaded object doesn't have the
+// checksum it should.
+type DownloadChecksumError struct {
+	Bucket    string
+	Key       string
+	Algorithm string
+	Expected  string
+	Got       string
+}
+
+func (e *DownloadChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch for s3://%s/%s: expected %s %s, got %s",
+		e.Bucket, e.Key, e.Algorithm, e.Expected, e.Got)
+}
+
+// DownloaderFactory is an interface to an object that makes new Downloader
+// instances.
+type DownloaderFactory interface {
+	NewDownloader() Downloader
+}
+
+// Downloader downloads objects from S3 to local files.
+type Downloader interface {
+	Download(*DownloadRequest) (*DownloadReceipt, error)
+	// DownloadWithContext is like Download, but gives up once ctx is done.
+	DownloadWithContext(context.Context, *DownloadRequest) (*DownloadReceipt, error)
+}
+
+type downloaderFactory struct {
+	client       s3iface.S3API
+	s3Downloader s3manageriface.DownloaderAPI
+	decompress   bool
+	retry        RetryPolicy
+}
+
+type downloader struct {
+	client       s3iface.S3API
+	s3Downloader s3manageriface.DownloaderAPI
+	decompress   bool
+	retry        RetryPolicy
+}
+
+// DownloaderOption configures optional behavior of the DownloaderFactory built
+// by NewDownloaderFactory.
+type DownloaderOption func(*downloaderFactory)
+
+// WithDecompression decompresses objects whose Content-Type says they are
+// gzip or zstd compressed, as the uploader's compressed uploads are, so the
+// local file holds the original data. Checksums are checked before
+// decompressing.
+func WithDecompression() DownloaderOption {
+	return func(f *downloaderFactory) {
+		f.decompress = true
+	}
+}
+
+// WithDownloadRetryPolicy sets the factory's retry policy. Zero fields of p
+// take their values from DefaultRetryPolicy.
+func WithDownloadRetryPolicy(p RetryPolicy) DownloaderOption {
+	return func(f *downloaderFactory) {
+		f.retry = f.retry.merge(&p)
+	}
+}
+
+// NewDownloaderFactory returns a DownloaderFactory whose downloaders look up
+// objects with client and download them with s3Downloader, which splits large
+// objects into ranges downloaded concurrently.
+func NewDownloaderFactory(client s3iface.S3API, s3Downloader s3manageriface.DownloaderAPI, opts ...DownloaderOption) DownloaderFactory {
+	f := &downloaderFactory{
+		client:       client,
+		s3Downloader: s3Downloader,
+		retry:        DefaultRetryPolicy,
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
+
+func (f *downloaderFactory) NewDownloader() Downloader {
+	return &downloader{
+		client:       f.client,
+		s3Downloader: f.s3Downloader,
+		decompress:   f.decompress,
+		retry:        f.retry,
+	}
+}
+
+func (d *downloader) Download(req *DownloadRequest) (*DownloadReceipt, error) {
+	return d.DownloadWithContext(context.Background(), req)
+}
+
+func (d *downloader) DownloadWithContext(ctx context.Context, req *DownloadRequest) (*DownloadReceipt, error) {
+	if req.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, req.Timeout)
+		defer cancel()
+	}
+	var receipt *DownloadReceipt
+	attempts, err := retryChanged(d.retry.merge(req.Retry)).retry(ctx, func() error {
+		var e error
+		receipt, e = d.download(ctx, req)
+		return e
+	})
+	if err != nil {
+		return nil, err
+	}
+	receipt.Attempts = attempts
+	return receipt, nil
+}
+
+// retryChanged returns p with PreconditionFailed errors made Retryable. They
+// mean the object changed between looking it up and downloading it, and each
+// attempt looks it up again.
+func retryChanged(p RetryPolicy) RetryPolicy {
+	classify := p.Classify
+	if classify == nil {
+		classify = ClassifyError
+	}
+	p.Classify = func(err error) ErrorClass {
+		if errorCode(err) == "PreconditionFailed" {
+			return Retryable
+		}
+		return classify(err)
+	}
+	return p
+}
+
+// download makes one attempt at downloading req.
+func (d *downloader) download(ctx context.Context, req *DownloadRequest) (*DownloadReceipt, error) {
+	var versionID *string
+	if req.VersionID != "" {
+		versionID = aws.String(req.VersionID)
+	}
+	head, err := d.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket:    aws.String(req.Bucket),
+		Key:       aws.String(req.Key),
+		VersionId: versionID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := tempFile(req.Filename)
+	if err != nil {
+		return nil, err
+	}
+	defer removeTemp(file)
+	// Insist on the object that was just looked up, in case it's
+	// overwritten part way through.
+	size, err := d.s3Downloader.DownloadWithContext(ctx, file, &s3.GetObjectInput{
+		Bucket:    aws.String(req.Bucket),
+		Key:       aws.String(req.Key),
+		VersionId: versionID,
+		IfMatch:   head.ETag,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sums := newChecksummer(ChecksumMD5 | ChecksumSHA256)
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(sums, file); err != nil {
+		return nil, err
+	}
+	if err = verifyDownload(req, head, sums); err != nil {
+		return nil, err
+	}
+
+	rawSize := size
+	contentType := FileTypeHeader(aws.StringValue(head.ContentType))
+	if compression := compressionOf(contentType); d.decompress && compression.enabled() {
+		if file, rawSize, err = decompressTemp(file, req.Filename, compression); err != nil {
+			return nil, err
+		}
+		defer removeTemp(file)
+	}
+	if err = file.Sync(); err != nil {
+		return nil, err
+	}
+	if err = file.Close(); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(file.Name(), req.Filename); err != nil {
+		return nil, err
+	}
+
+	return &DownloadReceipt{
+		Bucket:      req.Bucket,
+		Key:         req.Key,
+		VersionID:   aws.StringValue(head.VersionId),
+		Path:        req.Filename,
+		Size:        size,
+		RawSize:     rawSize,
+		MD5:         sums.MD5(),
+		SHA256:      sums.SHA256(),
+		ETag:        strings.Trim(aws.StringValue(head.ETag), `"`),
+		ContentType: contentType,
+		Metadata:    lowerKeys(aws.StringValueMap(head.Metadata)),
+	}, nil
+}
+
+// verifyDownload checks the checksums of a download of the object head
+// describes against those it should have.
+func verifyDownload(req *DownloadRequest, head *s3.HeadObjectOutput, sums *checksummer) error {
+	md5sum, sha256sum := req.MD5, req.SHA256
+	if md5sum == "" && sha256sum == "" {
+		metadata := lowerKeys(aws.StringValueMap(head.Metadata))
+		md5sum, sha256sum = metadata[MD5MetadataKey], metadata[SHA256MetadataKey]
+	}
+	// The ETags of multipart uploads and of objects encrypted with KMS
+	// aren't MD5s.
+	etag := strings.Trim(aws.StringValue(head.ETag), `"`)
+	if md5sum == "" && sha256sum == "" && !strings.Contains(etag, "-") &&
+		aws.StringValue(head.ServerSideEncryption) != s3.ServerSideEncryptionAwsKms {
+		md5sum = etag
+	}
+	for _, check := range []struct {
+		algorithm, expected, got string
+	}{
+		{"md5", md5sum, sums.MD5()},
+		{"sha256", sha256sum, sums.SHA256()},
+	} {
+		if check.expected != "" && !strings.EqualFold(check.expected, check.got) {
+			return &DownloadChecksumError{
+				Bucket:    req.Bucket,
+				Key:       req.Key,
+				Algorithm: check.algorithm,
+				Expected:  check.expected,
+				Got:       check.got,
+			}
+		}
+	}
+	return nil
+}
+
+// tempFile creates a hidden temporary file next to filename.
+func tempFile(filename string) (*os.File, error) {
+	return ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".download-")
+}
+
+// removeTemp closes and removes a temporary file, unless it has been renamed
+// into place.
+func removeTemp(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// decompressTemp decompresses compressed into a new temporary file next to
+// filename, and returns it with its size.
+func decompressTemp(compressed *os.File, filename string, compression Compression) (*os.File, int64, error) {
+	if _, err := compressed.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	zr, err := compression.newReader(compressed)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer zr.Close()
+	file, err := tempFile(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	n, err := io.Copy(file, zr)
+	if err != nil {
+		removeTemp(file)
+		return nil, 0, err
+	}
+	return file, n, nil
+}
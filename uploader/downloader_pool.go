@@ -0,0 +1,148 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrDownloaderPoolClosed is returned when a request is submitted to a
+// DownloaderPool which has been closed.
+var ErrDownloaderPoolClosed = errors.New("downloader pool is closed")
+
+// DOWNLOAD_BUFFER_SIZE is how many requests a DownloaderPool queues, and how
+// many receipts it holds for the reader of Receipts.
+const DOWNLOAD_BUFFER_SIZE = UPLOAD_BUFFER_SIZE
+
+// DownloadError is what a DownloaderPool sends its ErrorNotifier when a
+// download fails. Its message is that of Err.
+type DownloadError struct {
+	Request *DownloadRequest
+	// Attempts is how many times the download was tried, if known.
+	Attempts int
+	// Code is the AWS error code of Err, if it has one, e.g. NoSuchKey.
+	Code string
+	Err  error
+}
+
+func (e *DownloadError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *DownloadError) Unwrap() error {
+	return e.Err
+}
+
+// DownloaderPool downloads requests with a fixed number of Downloaders,
+// sending a receipt for each finished download on Receipts and each failure
+// to ErrorNotifier as a *DownloadError.
+type DownloaderPool struct {
+	Pool          []Downloader
+	ErrorNotifier ErrorNotifierHarness
+
+	in  chan *DownloadRequest
+	out chan *DownloadReceipt
+
+	// mu guards closed, so nothing is queued once in is closed.
+	mu        sync.RWMutex
+	closed    bool
+	closing   chan struct{}
+	closeOnce sync.Once
+	workers   sync.WaitGroup
+	finished  chan struct{}
+}
+
+// StartDownloaderPool starts numWorkers downloaders made by builder.
+func StartDownloaderPool(numWorkers int, errorNotifier ErrorNotifierHarness, builder DownloaderFactory) *DownloaderPool {
+	pool := &DownloaderPool{
+		ErrorNotifier: errorNotifier,
+		in:            make(chan *DownloadRequest, DOWNLOAD_BUFFER_SIZE),
+		out:           make(chan *DownloadReceipt, DOWNLOAD_BUFFER_SIZE),
+		closing:       make(chan struct{}),
+		finished:      make(chan struct{}),
+	}
+	for i := 0; i < numWorkers; i++ {
+		worker := builder.NewDownloader()
+		pool.Pool = append(pool.Pool, worker)
+		pool.workers.Add(1)
+		go pool.work(worker)
+	}
+	go func() {
+		pool.workers.Wait()
+		close(pool.out)
+		close(pool.finished)
+	}()
+	return pool
+}
+
+// Receipts returns the channel receipts of finished downloads are sent on.
+// It is closed once the pool is closed and every download has finished. It
+// must be read, or the workers stop once it is full.
+func (p *DownloaderPool) Receipts() <-chan *DownloadReceipt {
+	return p.out
+}
+
+// Download queues req, blocking until there is room in the queue. It returns
+// ErrDownloaderPoolClosed if the pool is closed.
+func (p *DownloaderPool) Download(req *DownloadRequest) error {
+	return p.DownloadWithContext(context.Background(), req)
+}
+
+// DownloadWithContext queues req, blocking until there is room in the queue
+// or ctx is done. ctx also governs the download itself.
+func (p *DownloaderPool) DownloadWithContext(ctx context.Context, req *DownloadRequest) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return ErrDownloaderPoolClosed
+	}
+	req.ctx = ctx
+	select {
+	case p.in <- req:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.closing:
+		return ErrDownloaderPoolClosed
+	}
+}
+
+// Close stops the pool accepting requests, and waits for everything queued to
+// be downloaded.
+func (p *DownloaderPool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.closing)
+		p.mu.Lock()
+		p.closed = true
+		close(p.in)
+		p.mu.Unlock()
+	})
+	<-p.finished
+}
+
+func (p *DownloaderPool) work(worker Downloader) {
+	defer p.workers.Done()
+	for req := range p.in {
+		p.process(worker, req)
+	}
+}
+
+// process downloads req with worker and sends its receipt.
+func (p *DownloaderPool) process(worker Downloader, req *DownloadRequest) {
+	ctx := req.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	receipt, err := worker.DownloadWithContext(ctx, req)
+	if err != nil {
+		downloadErr := &DownloadError{Request: req, Code: errorCode(err), Err: err}
+		var retryErr *RetryError
+		if errors.As(err, &retryErr) {
+			downloadErr.Attempts = retryErr.Attempts
+		}
+		p.ErrorNotifier.SendError(downloadErr)
+		return
+	}
+	p.out <- receipt
+}
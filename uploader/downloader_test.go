@@ -0,0 +1,197 @@
+package uploader
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/twitchscience/aws_utils/mocks"
+)
+
+// uploadToMock uploads contents to bucket with the given options, returning
+// the receipt.
+func uploadToMock(t *testing.T, bucket *mocks.S3, contents string, opts ...FactoryOption) *UploadReceipt {
+	opts = append([]FactoryOption{WithChecksums(ChecksumMD5 | ChecksumSHA256)}, opts...)
+	u := NewFactory("bucket", &simpleNameGenerator{prefix: "test"}, s3manager.NewUploaderWithClient(bucket), opts...).NewUploader()
+	receipt, err := u.Upload(NewDataRequest("object", []byte(contents), Text))
+	if err != nil {
+		t.Fatalf("Failed to upload: %v", err)
+	}
+	return receipt
+}
+
+func newMockDownloader(bucket *mocks.S3, opts ...DownloaderOption) Downloader {
+	return NewDownloaderFactory(bucket, s3manager.NewDownloaderWithClient(bucket, func(d *s3manager.Downloader) {
+		d.PartSize = s3manager.DefaultDownloadPartSize
+	}), opts...).NewDownloader()
+}
+
+// checkDownloadDir checks that dir holds only the downloaded file, with the
+// given contents.
+func checkDownloadDir(t *testing.T, dir, contents string) {
+	infos, _ := ioutil.ReadDir(dir)
+	if len(infos) != 1 || infos[0].Name() != "object" {
+		t.Errorf("Expected only the downloaded file in %s, got %v", dir, infos)
+	}
+	if body, _ := ioutil.ReadFile(filepath.Join(dir, "object")); string(body) != contents {
+		t.Errorf("Expected the downloaded file to hold the object")
+	}
+}
+
+func TestDownloader(t *testing.T) {
+	defer noBackoff()()
+	dir, err := ioutil.TempDir("", "downloader_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "object")
+
+	bucket := mocks.NewS3("bucket")
+	for _, contents := range []string{"hello world", strings.Repeat("0123456789", 1200000)} {
+		receipt := uploadToMock(t, bucket, contents)
+		msg := NewReceiptMessage(receipt, "")
+		downloaded, err := newMockDownloader(bucket).Download(NewDownloadRequest(msg, fn))
+		if err != nil {
+			t.Fatalf("Failed to download: %v", err)
+		}
+		if downloaded.Size != int64(len(contents)) || downloaded.MD5 != receipt.MD5 ||
+			downloaded.SHA256 != receipt.SHA256 || downloaded.Attempts != 1 {
+			t.Errorf("Expected a receipt matching %+v, got %+v", receipt, downloaded)
+		}
+		checkDownloadDir(t, dir, contents)
+	}
+	if gets := bucket.Calls("GetObject"); gets != 4 {
+		t.Errorf("Expected the large object to be downloaded in 3 ranges, got %d calls in all", gets)
+	}
+}
+
+func TestDownloaderDecompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "downloader_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "object")
+
+	bucket := mocks.NewS3("bucket")
+	receipt := uploadToMock(t, bucket, "hello world", WithCompression(GzipCompression))
+	req := &DownloadRequest{Bucket: "bucket", Key: "test/object.gz", Filename: fn}
+	downloaded, err := newMockDownloader(bucket, WithDecompression()).Download(req)
+	if err != nil {
+		t.Fatalf("Failed to download: %v", err)
+	}
+	if downloaded.Size != receipt.Size || downloaded.RawSize != 11 || downloaded.ContentType != Gzip {
+		t.Errorf("Expected a decompressed download of %+v, got %+v", receipt, downloaded)
+	}
+	checkDownloadDir(t, dir, "hello world")
+}
+
+func TestDownloaderFailures(t *testing.T) {
+	defer noBackoff()()
+	dir, err := ioutil.TempDir("", "downloader_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "object")
+
+	bucket := mocks.NewS3("bucket")
+	bucket.Put("bucket", "corrupt", []byte("hello world"), map[string]string{MD5MetadataKey: "00000000000000000000000000000000"})
+	_, err = newMockDownloader(bucket).Download(&DownloadRequest{Bucket: "bucket", Key: "corrupt", Filename: fn})
+	retryErr, ok := err.(*RetryError)
+	if !ok || retryErr.Attempts != DefaultRetryPolicy.MaxAttempts {
+		t.Fatalf("Expected corrupt downloads to be retried, got %#v", err)
+	}
+	if _, ok := retryErr.Err.(*DownloadChecksumError); !ok {
+		t.Errorf("Expected a DownloadChecksumError, got %v", retryErr.Err)
+	}
+
+	_, err = newMockDownloader(bucket).Download(&DownloadRequest{Bucket: "bucket", Key: "missing", Filename: fn})
+	if retryErr, ok := err.(*RetryError); !ok || retryErr.Attempts != 1 || retryErr.Class != Permanent {
+		t.Errorf("Expected missing objects to fail straight away, got %#v", err)
+	}
+	if infos, _ := ioutil.ReadDir(dir); len(infos) != 0 {
+		t.Errorf("Expected failed downloads to leave nothing behind, got %v", infos)
+	}
+}
+
+func TestDownloaderPool(t *testing.T) {
+	defer noBackoff()()
+	dir, err := ioutil.TempDir("", "downloader_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bucket := mocks.NewS3("bucket")
+	keys := []string{"a", "b", "c"}
+	for _, key := range keys {
+		bucket.Put("bucket", key, []byte(key), nil)
+	}
+	errorNotifier := &recordingErrorNotifier{}
+	pool := StartDownloaderPool(2, errorNotifier, NewDownloaderFactory(bucket, s3manager.NewDownloaderWithClient(bucket)))
+	for _, key := range append(keys, "missing") {
+		if err := pool.Download(&DownloadRequest{Bucket: "bucket", Key: key, Filename: filepath.Join(dir, key)}); err != nil {
+			t.Fatalf("Failed to queue %s: %v", key, err)
+		}
+	}
+	go pool.Close()
+
+	downloaded := 0
+	for receipt := range pool.Receipts() {
+		downloaded++
+		if body, _ := ioutil.ReadFile(receipt.Path); !bytes.Equal(body, []byte(receipt.Key)) {
+			t.Errorf("Expected %s to hold %s", receipt.Path, receipt.Key)
+		}
+	}
+	if downloaded != len(keys) {
+		t.Errorf("Expected %d receipts, got %d", len(keys), downloaded)
+	}
+	errs := errorNotifier.errors()
+	if len(errs) != 1 {
+		t.Fatalf("Expected 1 error, got %v", errs)
+	}
+	if downloadErr, ok := errs[0].(*DownloadError); !ok || downloadErr.Request.Key != "missing" || downloadErr.Code != "NotFound" {
+		t.Errorf("Expected a DownloadError for the missing key, got %#v", errs[0])
+	}
+	if err := pool.Download(&DownloadRequest{Bucket: "bucket", Key: "a"}); err != ErrDownloaderPoolClosed {
+		t.Errorf("Expected %v after Close, got %v", ErrDownloaderPoolClosed, err)
+	}
+}
+
+func TestDownloaderObjectChanged(t *testing.T) {
+	defer noBackoff()()
+	dir, err := ioutil.TempDir("", "downloader_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "object")
+
+	bucket := mocks.NewS3("bucket")
+	bucket.Put("bucket", "object", []byte("hello world"), nil)
+	// The object is overwritten between the HEAD and the GET of the first
+	// attempt.
+	gets := 0
+	bucket.Fault = func(op, _, _ string) error {
+		if op == "GetObject" {
+			if gets++; gets == 1 {
+				return requestFailure("PreconditionFailed", 412)
+			}
+		}
+		return nil
+	}
+	downloaded, err := newMockDownloader(bucket).Download(&DownloadRequest{Bucket: "bucket", Key: "object", Filename: fn})
+	if err != nil {
+		t.Fatalf("Failed to download: %v", err)
+	}
+	if downloaded.Attempts != 2 {
+		t.Errorf("Expected the download to be retried once, got %d attempts", downloaded.Attempts)
+	}
+	checkDownloadDir(t, dir, "hello world")
+}
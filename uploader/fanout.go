@@ -0,0 +1,226 @@
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
+	"github.com/twitchscience/aws_utils/logger"
+)
+
+// SuccessPolicy says how many destinations of a fan-out upload must succeed
+// for the upload to succeed.
+type SuccessPolicy int
+
+const (
+	// RequireAll needs every destination to succeed.
+	RequireAll SuccessPolicy = iota
+	// RequireAny needs at least one destination to succeed.
+	RequireAny
+	// RequireQuorum needs more than half of the destinations to succeed.
+	RequireQuorum
+)
+
+func (p SuccessPolicy) satisfied(succeeded, total int) bool {
+	switch p {
+	case RequireAny:
+		return succeeded > 0
+	case RequireQuorum:
+		return succeeded > total/2
+	default:
+		return succeeded == total
+	}
+}
+
+// Destination is one of the places a fan-out Factory uploads each file to.
+// Each has its own bucket, key name generator and s3manager client, so they
+// can be in different regions or accounts.
+type Destination struct {
+	// Name identifies the destination in receipts. It defaults to Bucket.
+	Name             string
+	Bucket           string
+	KeyNameGenerator S3KeyNameGenerator
+	S3Uploader       s3manageriface.UploaderAPI
+	// Options are applied after the Factory wide options, e.g. to use a
+	// different storage class for a backup copy.
+	Options []FactoryOption
+}
+
+// DestinationReceipt is the outcome of uploading to one Destination.
+// Receipt is nil if the upload failed, in which case Error says why.
+type DestinationReceipt struct {
+	Name    string
+	Receipt *UploadReceipt
+	Error   string
+}
+
+// FanOutError is returned when too few destinations of a fan-out upload
+// succeeded to satisfy its SuccessPolicy.
+type FanOutError struct {
+	Destinations []DestinationReceipt
+
+	errs []error
+}
+
+func (e *FanOutError) Error() string {
+	var failures []string
+	for _, d := range e.Destinations {
+		if d.Receipt == nil {
+			failures = append(failures, d.Name+": "+d.Error)
+		}
+	}
+	return fmt.Sprintf("upload failed to %d of %d destinations: %s",
+		len(failures), len(e.Destinations), strings.Join(failures, "; "))
+}
+
+// Unwrap returns the errors of the destinations which failed, so errors.As
+// finds e.g. the *RetryError of the first.
+func (e *FanOutError) Unwrap() []error {
+	return e.errs
+}
+
+type fanOutFactory struct {
+	destinations []Destination
+	policy       SuccessPolicy
+	opts         []FactoryOption
+	disposer     Disposer
+}
+
+type fanOutUploader struct {
+	names    []string
+	workers  []*uploader
+	policy   SuccessPolicy
+	disposer Disposer
+}
+
+// NewFanOutFactory returns a Factory whose uploaders upload each file to all
+// of destinations at once. opts apply to every destination. The file is
+// disposed of once, after every destination has finished, using the
+// disposer from opts, and the upload is treated as successful if policy is
+// satisfied.
+//
+// The receipt of a successful upload describes the first of destinations
+// which succeeded, and lists every destination's outcome in Destinations. If policy
+// isn't satisfied the error is a *FanOutError.
+func NewFanOutFactory(policy SuccessPolicy, destinations []Destination, opts ...FactoryOption) Factory {
+	base := &factory{disposer: RemoveAlways}
+	for _, opt := range opts {
+		opt(base)
+	}
+	return &fanOutFactory{
+		destinations: destinations,
+		policy:       policy,
+		opts:         opts,
+		disposer:     base.disposer,
+	}
+}
+
+func (f *fanOutFactory) NewUploader() Uploader {
+	u := &fanOutUploader{
+		policy:   f.policy,
+		disposer: f.disposer,
+	}
+	for _, d := range f.destinations {
+		name := d.Name
+		if name == "" {
+			name = d.Bucket
+		}
+		var opts []FactoryOption
+		opts = append(opts, f.opts...)
+		opts = append(opts, d.Options...)
+		// Only the fan-out uploader disposes of the file, once every
+		// destination is done with it.
+		opts = append(opts, WithDisposer(Keep))
+		u.names = append(u.names, name)
+		u.workers = append(u.workers, NewFactory(d.Bucket, d.KeyNameGenerator, d.S3Uploader, opts...).NewUploader().(*uploader))
+	}
+	return u
+}
+
+func (u *fanOutUploader) Upload(req *UploadRequest) (*UploadReceipt, error) {
+	return u.UploadWithContext(context.Background(), req)
+}
+
+func (u *fanOutUploader) UploadWithContext(ctx context.Context, req *UploadRequest) (*UploadReceipt, error) {
+	if len(u.workers) == 0 {
+		return nil, fmt.Errorf("no destinations to upload %s to", req.Filename)
+	}
+	for _, worker := range u.workers {
+		if err := worker.validate(req); err != nil {
+			return nil, err
+		}
+	}
+	// The destinations can't share a reader.
+	shared, err := req.buffered()
+	if err != nil {
+		return nil, err
+	}
+	if shared.uploaded != nil {
+		// The receipt is only complete once every destination is done.
+		copied := *shared
+		copied.uploaded = nil
+		shared = &copied
+	}
+	results := make([]DestinationReceipt, len(u.workers))
+	errs := make([]error, len(u.workers))
+	var wg sync.WaitGroup
+	for i, worker := range u.workers {
+		wg.Add(1)
+		go func(i int, worker *uploader) {
+			defer wg.Done()
+			results[i].Name = u.names[i]
+			results[i].Receipt, errs[i] = worker.UploadWithContext(ctx, shared)
+			if errs[i] != nil {
+				results[i].Error = errs[i].Error()
+			}
+		}(i, worker)
+	}
+	wg.Wait()
+
+	var receipt *UploadReceipt
+	succeeded := 0
+	missing := true
+	for i, r := range results {
+		if r.Receipt != nil {
+			succeeded++
+			if receipt == nil {
+				primary := *r.Receipt
+				receipt = &primary
+			}
+		}
+		missing = missing && os.IsNotExist(errs[i])
+	}
+	if !u.policy.satisfied(succeeded, len(results)) {
+		err = ctx.Err()
+		if err == nil {
+			failed := &FanOutError{Destinations: results}
+			for _, e := range errs {
+				if e != nil {
+					failed.errs = append(failed.errs, e)
+				}
+			}
+			err = failed
+		}
+	}
+	if missing {
+		return nil, errs[0]
+	}
+	if err == nil {
+		receipt.Destinations = results
+		if req.uploaded != nil {
+			req.uploaded(receipt)
+		}
+	}
+	if req.isFile() {
+		if derr := u.disposer.Dispose(req, err); derr != nil {
+			logger.WithError(derr).WithField("filename", req.Filename).Error("Failed to dispose of uploaded file")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return receipt, nil
+}
@@ -0,0 +1,159 @@
+package uploader
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
+	"github.com/twitchscience/aws_utils/mocks"
+)
+
+// failingS3Uploader fails every upload.
+type failingS3Uploader struct {
+	s3manageriface.UploaderAPI
+}
+
+func (f *failingS3Uploader) UploadWithContext(ctx aws.Context, in *s3manager.UploadInput, opts ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	return nil, errors.New("region unavailable")
+}
+
+func TestFanOutUploader(t *testing.T) {
+	defer noBackoff()()
+
+	for _, tc := range []struct {
+		policy    SuccessPolicy
+		failures  int
+		succeeded bool
+	}{
+		{policy: RequireAll, failures: 0, succeeded: true},
+		{policy: RequireAll, failures: 1, succeeded: false},
+		{policy: RequireQuorum, failures: 1, succeeded: true},
+		{policy: RequireQuorum, failures: 2, succeeded: false},
+		{policy: RequireAny, failures: 2, succeeded: true},
+		{policy: RequireAny, failures: 3, succeeded: false},
+	} {
+		filename := writeTempFile(t, "fan out")
+		destinations := make([]Destination, 3)
+		recorders := make([]*recordingS3Uploader, 3)
+		for i := range destinations {
+			recorders[i] = &recordingS3Uploader{}
+			destinations[i] = Destination{
+				Bucket:           "bucket" + string(rune('a'+i)),
+				KeyNameGenerator: &simpleNameGenerator{prefix: "logs"},
+				S3Uploader:       recorders[i],
+			}
+			// Fail the first destinations so the receipt comes from a later
+			// one.
+			if i < tc.failures {
+				destinations[i].S3Uploader = &failingS3Uploader{}
+			}
+		}
+		destinations[2].Name = "backup"
+		destinations[2].Options = []FactoryOption{WithStorageClass("GLACIER")}
+
+		u := NewFanOutFactory(tc.policy, destinations, WithDisposer(RemoveOnSuccess)).NewUploader()
+		receipt, err := u.Upload(&UploadRequest{Filename: filename, FileType: Text})
+
+		_, statErr := os.Stat(filename)
+		if tc.succeeded {
+			if err != nil {
+				t.Fatalf("policy %d with %d failures: expected success but got %v", tc.policy, tc.failures, err)
+			}
+			if !os.IsNotExist(statErr) {
+				t.Errorf("policy %d with %d failures: expected file to be removed", tc.policy, tc.failures)
+			}
+			expectedKey := "bucket" + string(rune('a'+tc.failures)) + "/logs/" + filename
+			if receipt.KeyName != expectedKey {
+				t.Errorf("expected receipt for %s but got %s", expectedKey, receipt.KeyName)
+			}
+			if len(receipt.Destinations) != 3 {
+				t.Fatalf("expected 3 destinations but got %v", receipt.Destinations)
+			}
+			for i, d := range receipt.Destinations {
+				if failed := i < tc.failures; failed != (d.Receipt == nil) || failed != (d.Error != "") {
+					t.Errorf("destination %d: expected failed=%v but got %+v", i, failed, d)
+				}
+			}
+			if name := receipt.Destinations[2].Name; name != "backup" {
+				t.Errorf("expected destination name backup but got %s", name)
+			}
+			if class := aws.StringValue(recorders[2].inputs[0].StorageClass); class != "GLACIER" {
+				t.Errorf("expected backup storage class GLACIER but got %s", class)
+			}
+		} else {
+			os.Remove(filename)
+			fanOutErr, ok := err.(*FanOutError)
+			if !ok {
+				t.Fatalf("policy %d with %d failures: expected *FanOutError but got %v", tc.policy, tc.failures, err)
+			}
+			if statErr != nil {
+				t.Errorf("policy %d with %d failures: expected file to be kept", tc.policy, tc.failures)
+			}
+			if fanOutErr.Destinations[0].Name != "bucketa" {
+				t.Errorf("expected destination name to default to the bucket, got %s", fanOutErr.Destinations[0].Name)
+			}
+		}
+	}
+}
+
+func TestFanOutUploaderInvalidRequest(t *testing.T) {
+	filename := writeTempFile(t, "fan out")
+	defer os.Remove(filename)
+	recorder := &recordingS3Uploader{}
+	u := NewFanOutFactory(RequireAny, []Destination{
+		{Bucket: "bucket", KeyNameGenerator: &simpleNameGenerator{prefix: "logs"}, S3Uploader: recorder},
+	}).NewUploader()
+	if _, err := u.Upload(&UploadRequest{Filename: filename, Tags: map[string]string{"aws:reserved": "v"}}); err == nil {
+		t.Error("expected an error for invalid tags")
+	}
+	if _, err := os.Stat(filename); err != nil {
+		t.Errorf("expected the file to be kept but got %v", err)
+	}
+	if len(recorder.inputs) != 0 {
+		t.Errorf("expected nothing to be uploaded but got %d uploads", len(recorder.inputs))
+	}
+}
+
+func TestFanOutUploaderRequeue(t *testing.T) {
+	defer noBackoff()()
+	filename := writeTempFile(t, "fan out")
+	defer os.Remove(filename)
+
+	bucket := mocks.NewS3("bucketb")
+	bucket.Fault = func(op, _, _ string) error {
+		return requestFailure("InternalError", 500)
+	}
+	u := NewFanOutFactory(RequireAll, []Destination{
+		{Bucket: "bucketa", KeyNameGenerator: &simpleNameGenerator{prefix: "logs"}, S3Uploader: &recordingS3Uploader{}},
+		{Bucket: "bucketb", KeyNameGenerator: &simpleNameGenerator{prefix: "logs"}, S3Uploader: s3manager.NewUploaderWithClient(bucket)},
+	}, WithDisposer(RemoveOnSuccess)).NewUploader()
+	req := &UploadRequest{Filename: filename, FileType: Text}
+	_, err := u.Upload(req)
+	if err == nil {
+		t.Fatal("Expected the upload to fail")
+	}
+
+	uploadErr := newUploadError(StageUpload, req, nil, err)
+	if uploadErr.Code != "InternalError" || uploadErr.Attempts != DefaultRetryPolicy.MaxAttempts {
+		t.Errorf("Expected code InternalError after %d attempts, got %q after %d",
+			DefaultRetryPolicy.MaxAttempts, uploadErr.Code, uploadErr.Attempts)
+	}
+	requeued := make(chan *UploadRequest, 1)
+	n := &RequeueErrorNotifier{Requeue: func(r *UploadRequest) error {
+		requeued <- r
+		return nil
+	}}
+	n.SendError(uploadErr)
+	select {
+	case r := <-requeued:
+		if r != req {
+			t.Errorf("Expected %v to be requeued, got %v", req, r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the fan-out failure to be requeued")
+	}
+}
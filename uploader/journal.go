@@ -0,0 +1,235 @@
+package uploader
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+)
+
+const (
+	journalAccepted = "accepted"
+	journalUploaded = "uploaded"
+	journalFailed   = "failed"
+	journalNotified = "notified"
+
+	// compactThreshold is how many entries may be written before the journal
+	// is rewritten to drop completed work.
+	compactThreshold = 10000
+)
+
+// Journal is a write-ahead log of the work an UploaderPool has accepted. It
+// records each request when it is queued, each receipt when its upload
+// finishes, and each notification once it is sent, syncing every record to
+// disk. Opening an existing journal recovers whatever was left unfinished,
+// and a pool started with WithJournal resubmits it, so every accepted file is
+// uploaded and notified at least once even if the process dies in between.
+//
+// A request whose upload fails is considered finished once the failure has
+// been sent to the ErrorNotifier. A receipt whose notification fails stays in
+// the journal and is notified again the next time the journal is opened.
+type Journal struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	seq     uint64
+	written int
+	// pending is the latest entry for each request that isn't finished.
+	pending map[uint64]*journalEntry
+}
+
+type journalEntry struct {
+	Op      string         `json:"op"`
+	Seq     uint64         `json:"seq"`
+	Request *UploadRequest `json:"request,omitempty"`
+	Receipt *UploadReceipt `json:"receipt,omitempty"`
+}
+
+// OpenJournal opens the journal at path, creating it if needed, and recovers
+// any unfinished work recorded in it.
+func OpenJournal(path string) (*Journal, error) {
+	j := &Journal{
+		path:    path,
+		pending: make(map[uint64]*journalEntry),
+	}
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+	if err := j.compact(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *Journal) load() error {
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var e journalEntry
+		// A crash can leave a partially written final entry; skip it.
+		if json.Unmarshal(scanner.Bytes(), &e) != nil {
+			continue
+		}
+		if e.Seq > j.seq {
+			j.seq = e.Seq
+		}
+		j.apply(&e)
+	}
+	return scanner.Err()
+}
+
+// apply updates the pending set with e.
+func (j *Journal) apply(e *journalEntry) {
+	switch e.Op {
+	case journalAccepted, journalUploaded:
+		j.pending[e.Seq] = e
+	case journalFailed, journalNotified:
+		delete(j.pending, e.Seq)
+	}
+}
+
+// compact rewrites the journal so it only holds pending entries.
+func (j *Journal) compact() error {
+	if j.file != nil {
+		if err := j.file.Close(); err != nil {
+			return err
+		}
+		j.file = nil
+	}
+
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, e := range j.sortedPending() {
+		if err = enc.Encode(e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, j.path); err != nil {
+		return err
+	}
+
+	j.file, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0644)
+	j.written = len(j.pending)
+	return err
+}
+
+func (j *Journal) sortedPending() []*journalEntry {
+	entries := make([]*journalEntry, 0, len(j.pending))
+	for _, e := range j.pending {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(a, b int) bool {
+		return entries[a].Seq < entries[b].Seq
+	})
+	return entries
+}
+
+// write appends e to the journal and syncs it to disk.
+func (j *Journal) write(e *journalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err = j.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if err = j.file.Sync(); err != nil {
+		return err
+	}
+	j.apply(e)
+	j.written++
+	if j.written > compactThreshold && j.written > 2*len(j.pending) {
+		return j.compact()
+	}
+	return nil
+}
+
+// Pending returns the requests which were accepted but not uploaded and the
+// receipts which were uploaded but not notified, in the order they were
+// accepted.
+func (j *Journal) Pending() ([]*UploadRequest, []*UploadReceipt) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var requests []*UploadRequest
+	var receipts []*UploadReceipt
+	for _, e := range j.sortedPending() {
+		switch e.Op {
+		case journalAccepted:
+			e.Request.seq = e.Seq
+			requests = append(requests, e.Request)
+		case journalUploaded:
+			e.Receipt.seq = e.Seq
+			receipts = append(receipts, e.Receipt)
+		}
+	}
+	return requests, receipts
+}
+
+// The methods below record the progress of a request. They do nothing on a
+// nil Journal, so the pool can call them whether or not it has one, and
+// nothing for in-memory requests, which can't be recovered after a crash and
+// so are never given a sequence number.
+
+func (j *Journal) accepted(req *UploadRequest) error {
+	if j == nil || !req.isFile() {
+		return nil
+	}
+	j.mu.Lock()
+	j.seq++
+	req.seq = j.seq
+	j.mu.Unlock()
+	return j.write(&journalEntry{Op: journalAccepted, Seq: req.seq, Request: req})
+}
+
+func (j *Journal) uploaded(receipt *UploadReceipt) error {
+	if j == nil || receipt.seq == 0 {
+		return nil
+	}
+	return j.write(&journalEntry{Op: journalUploaded, Seq: receipt.seq, Receipt: receipt})
+}
+
+func (j *Journal) failed(req *UploadRequest) error {
+	if j == nil || req.seq == 0 {
+		return nil
+	}
+	return j.write(&journalEntry{Op: journalFailed, Seq: req.seq})
+}
+
+func (j *Journal) notified(receipt *UploadReceipt) error {
+	if j == nil || receipt.seq == 0 {
+		return nil
+	}
+	return j.write(&journalEntry{Op: journalNotified, Seq: receipt.seq})
+}
+
+// Close closes the journal file. Close the pool using the journal first.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
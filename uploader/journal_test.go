@@ -0,0 +1,193 @@
+package uploader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestJournalRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal_test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal")
+
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatalf("Error opening journal: %v", err)
+	}
+	var requests []*UploadRequest
+	for _, fn := range []string{"notified", "uploaded", "failed", "accepted"} {
+		req := &UploadRequest{Filename: fn, FileType: Gzip}
+		if err = j.accepted(req); err != nil {
+			t.Fatalf("Error journaling %s: %v", fn, err)
+		}
+		requests = append(requests, req)
+	}
+	for _, req := range requests[:2] {
+		if err = j.uploaded(&UploadReceipt{Path: req.Filename, KeyName: "bucket/" + req.Filename, seq: req.seq}); err != nil {
+			t.Fatalf("Error journaling upload of %s: %v", req.Filename, err)
+		}
+	}
+	if err = j.notified(&UploadReceipt{seq: requests[0].seq}); err != nil {
+		t.Fatalf("Error journaling notification: %v", err)
+	}
+	if err = j.failed(requests[2]); err != nil {
+		t.Fatalf("Error journaling failure: %v", err)
+	}
+	if err = j.Close(); err != nil {
+		t.Fatalf("Error closing journal: %v", err)
+	}
+
+	// Simulate a crash in the middle of writing an entry.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("Error opening journal file: %v", err)
+	}
+	f.WriteString(`{"op":"notif`)
+	f.Close()
+
+	j, err = OpenJournal(path)
+	if err != nil {
+		t.Fatalf("Error reopening journal: %v", err)
+	}
+	defer j.Close()
+	pendingRequests, pendingReceipts := j.Pending()
+	expectedRequests := []*UploadRequest{{Filename: "accepted", FileType: Gzip, seq: 4}}
+	if !reflect.DeepEqual(pendingRequests, expectedRequests) {
+		t.Errorf("expected %+v but got %+v", expectedRequests[0], pendingRequests)
+	}
+	expectedReceipts := []*UploadReceipt{{Path: "uploaded", KeyName: "bucket/uploaded", seq: 2}}
+	if !reflect.DeepEqual(pendingReceipts, expectedReceipts) {
+		t.Errorf("expected %+v but got %+v", expectedReceipts[0], pendingReceipts)
+	}
+
+	// New requests must not reuse sequence numbers from before the restart.
+	req := &UploadRequest{Filename: "new"}
+	if err = j.accepted(req); err != nil {
+		t.Fatalf("Error journaling %s: %v", req.Filename, err)
+	}
+	if req.seq != 5 {
+		t.Errorf("expected seq 5 but got %d", req.seq)
+	}
+}
+
+func TestUploaderPoolJournalReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal_test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal")
+
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatalf("Error opening journal: %v", err)
+	}
+	queued := &UploadRequest{Filename: "test1", FileType: Gzip}
+	uploaded := &UploadRequest{Filename: "test2", FileType: Gzip}
+	j.accepted(queued)
+	j.accepted(uploaded)
+	j.uploaded(&UploadReceipt{Path: "test2", KeyName: "test2", seq: uploaded.seq})
+	j.Close()
+
+	j, err = OpenJournal(path)
+	if err != nil {
+		t.Fatalf("Error reopening journal: %v", err)
+	}
+	testPool := StartUploaderPool(
+		2,
+		&errorCaptureNotifier{},
+		&captureNotifier{},
+		&testUploadBuilder{},
+		WithJournal(j),
+	)
+	testPool.Upload(&UploadRequest{Filename: "notifyerror3", FileType: Gzip})
+	testPool.Close()
+
+	expectedNotifies := []string{"test1", "test2"}
+	sort.Strings(testPool.Notifier.(*captureNotifier).receipt)
+	if !reflect.DeepEqual(testPool.Notifier.(*captureNotifier).receipt, expectedNotifies) {
+		t.Errorf("expected %s got %s\n", expectedNotifies,
+			testPool.Notifier.(*captureNotifier).receipt,
+		)
+	}
+
+	// Only the receipt which failed to notify should be left over.
+	requests, receipts := j.Pending()
+	if len(requests) != 0 || len(receipts) != 1 || receipts[0].Path != "notifyerror3" {
+		t.Errorf("expected only notifyerror3 to be pending, got %v and %v", requests, receipts)
+	}
+	j.Close()
+}
+
+func TestUploaderPoolJournalsBeforeDisposing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal_test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "upload")
+
+	j, err := OpenJournal(filepath.Join(dir, "journal"))
+	if err != nil {
+		t.Fatalf("Error opening journal: %v", err)
+	}
+	defer j.Close()
+	// If the process died as the file was removed, the journal should
+	// already say the file was uploaded, so its receipt is notified on
+	// replay rather than the missing file being uploaded again.
+	var requests []*UploadRequest
+	var receipts []*UploadReceipt
+	disposer := DisposerFunc(func(req *UploadRequest, uploadErr error) error {
+		requests, receipts = j.Pending()
+		return RemoveAlways.Dispose(req, uploadErr)
+	})
+	for _, builder := range []Factory{
+		NewFactory("bucket", &simpleNameGenerator{prefix: "logs"}, &recordingS3Uploader{}, WithDisposer(disposer)),
+		NewFanOutFactory(RequireAll, []Destination{
+			{Bucket: "bucket", KeyNameGenerator: &simpleNameGenerator{prefix: "logs"}, S3Uploader: &recordingS3Uploader{}},
+		}, WithDisposer(disposer)),
+	} {
+		if err = ioutil.WriteFile(filename, []byte("upload"), 0644); err != nil {
+			t.Fatalf("Error writing file: %v", err)
+		}
+		requests, receipts = nil, nil
+		pool := StartUploaderPool(1, &errorCaptureNotifier{}, &captureNotifier{}, builder, WithJournal(j))
+		pool.Upload(&UploadRequest{Filename: filename, FileType: Text})
+		pool.Close()
+
+		if len(requests) != 0 || len(receipts) != 1 || receipts[0].Path != filename {
+			t.Errorf("expected the receipt to be journaled before disposing, got %v and %v", requests, receipts)
+		}
+	}
+}
+
+func TestJournalSkipsInMemoryRequests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal_test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	j, err := OpenJournal(filepath.Join(dir, "journal"))
+	if err != nil {
+		t.Fatalf("Error opening journal: %v", err)
+	}
+	defer j.Close()
+	req := NewDataRequest("data", []byte("data"), Text)
+	if err = j.accepted(req); err != nil {
+		t.Fatalf("Error journaling request: %v", err)
+	}
+	if err = j.uploaded(&UploadReceipt{Path: req.Filename, seq: req.seq}); err != nil {
+		t.Fatalf("Error journaling upload: %v", err)
+	}
+	if requests, receipts := j.Pending(); len(requests) != 0 || len(receipts) != 0 {
+		t.Errorf("expected nothing pending but got %v and %v", requests, receipts)
+	}
+}
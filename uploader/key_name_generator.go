@@ -1,5 +1,282 @@
 package uploader
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/twinj/uuid"
+	"github.com/twitchscience/aws_utils/logger"
+)
+
 type S3KeyNameGenerator interface {
 	GetKeyName(string) string
 }
+
+// RequestKeyNameGenerator is an S3KeyNameGenerator which can also look at the
+// UploadRequest being uploaded. The uploader calls GetRequestKeyName instead
+// of GetKeyName for generators which implement it. filename is the request's
+// Filename with any compression extension appended.
+type RequestKeyNameGenerator interface {
+	S3KeyNameGenerator
+	GetRequestKeyName(filename string, req *UploadRequest) string
+}
+
+// getKeyName generates the key name for req using g.
+func getKeyName(g S3KeyNameGenerator, filename string, req *UploadRequest) string {
+	if rg, ok := g.(RequestKeyNameGenerator); ok {
+		return rg.GetRequestKeyName(filename, req)
+	}
+	return g.GetKeyName(filename)
+}
+
+// Clock returns the current time. Generators which use the time take one so
+// tests can control their output; a nil Clock means time.Now.
+type Clock func() time.Time
+
+func (c Clock) now() time.Time {
+	if c == nil {
+		return time.Now().UTC()
+	}
+	return c().UTC()
+}
+
+func join(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return path.Join(prefix, name)
+}
+
+// splitExt splits the base name of filename at its first dot, so
+// "dir/events.log.gz" gives "events" and ".log.gz".
+func splitExt(filename string) (string, string) {
+	base := filepath.Base(filename)
+	if i := strings.Index(base, "."); i > 0 {
+		return base[:i], base[i:]
+	}
+	return base, ""
+}
+
+// HivePartitionKeyNameGenerator puts files under Hive style date and hour
+// partitions of the current UTC time, e.g. prefix/dt=2017-06-01/hr=13/name.
+type HivePartitionKeyNameGenerator struct {
+	Prefix string
+	Clock  Clock
+}
+
+// GetKeyName implements S3KeyNameGenerator.
+func (g *HivePartitionKeyNameGenerator) GetKeyName(filename string) string {
+	now := g.Clock.now()
+	return join(g.Prefix, now.Format("dt=2006-01-02/hr=15/")+filepath.Base(filename))
+}
+
+// UniqueKeyNameGenerator makes the keys of another generator unique by adding
+// the hostname, pid and/or a random UUID before the extension, so
+// "logs/events.log.gz" becomes e.g. "logs/events.host1.1234.<uuid>.log.gz".
+type UniqueKeyNameGenerator struct {
+	Inner    S3KeyNameGenerator
+	Hostname bool
+	PID      bool
+	UUID     bool
+}
+
+// GetKeyName implements S3KeyNameGenerator.
+func (g *UniqueKeyNameGenerator) GetKeyName(filename string) string {
+	return g.uniquify(g.Inner.GetKeyName(filename))
+}
+
+// GetRequestKeyName implements RequestKeyNameGenerator.
+func (g *UniqueKeyNameGenerator) GetRequestKeyName(filename string, req *UploadRequest) string {
+	return g.uniquify(getKeyName(g.Inner, filename, req))
+}
+
+func (g *UniqueKeyNameGenerator) uniquify(key string) string {
+	var parts []string
+	if g.Hostname {
+		parts = append(parts, hostname())
+	}
+	if g.PID {
+		parts = append(parts, strconv.Itoa(os.Getpid()))
+	}
+	if g.UUID {
+		parts = append(parts, uuid.NewV4().String())
+	}
+	if len(parts) == 0 {
+		return key
+	}
+	dir, base := path.Split(key)
+	name, ext := splitExt(base)
+	return dir + name + "." + strings.Join(parts, ".") + ext
+}
+
+func hostname() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	return host
+}
+
+// ContentHashKeyNameGenerator names each file after the SHA-256 of its
+// contents, keeping its extension, e.g. prefix/<sha256>.log.gz. Identical
+// files therefore map to the same key. In-memory requests are named after the
+// SHA-256 of their Data or Reader. If the contents can't be read, the base
+// name is used instead.
+type ContentHashKeyNameGenerator struct {
+	Prefix string
+}
+
+// GetKeyName implements S3KeyNameGenerator. filename should be the file to
+// hash.
+func (g *ContentHashKeyNameGenerator) GetKeyName(filename string) string {
+	return g.GetRequestKeyName(filename, &UploadRequest{Filename: filename})
+}
+
+// GetRequestKeyName implements RequestKeyNameGenerator.
+func (g *ContentHashKeyNameGenerator) GetRequestKeyName(filename string, req *UploadRequest) string {
+	_, ext := splitExt(filename)
+	sum, err := hashRequest(req)
+	if err != nil {
+		logger.WithError(err).WithField("filename", req.Filename).Error("Failed to hash file for key name")
+		return join(g.Prefix, filepath.Base(filename))
+	}
+	return join(g.Prefix, sum+ext)
+}
+
+// hashRequest returns the hex SHA-256 of what req uploads. A Reader is read
+// from the start and left there, so it has to be an io.ReadSeeker; the
+// uploader makes sure of that before naming the object.
+func hashRequest(req *UploadRequest) (string, error) {
+	switch req.kind() {
+	case fromData:
+		sum := sha256.Sum256(req.Data)
+		return hex.EncodeToString(sum[:]), nil
+	case fromReader:
+		rs, ok := req.Reader.(io.ReadSeeker)
+		if !ok {
+			return "", errors.New("can't hash a reader which can't seek")
+		}
+		if _, err := rs.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, rs); err != nil {
+			return "", err
+		}
+		if _, err := rs.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+	return hashFile(req.Filename)
+}
+
+func hashFile(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+var templateVariable = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// TemplateKeyNameGenerator builds keys from a template such as
+// "{prefix}/{yyyy}/{mm}/{host}/{basename}.{uuid}". The variables are:
+//
+//	{prefix}         the Prefix field
+//	{yyyy} {mm} {dd} {hh}
+//	                 the current UTC year, month, day and hour
+//	{host} {pid}     the hostname and process id
+//	{uuid}           a random UUID
+//	{basename}       the base name of the file, e.g. events.log.gz
+//	{name} {ext}     the base name split at its first dot, e.g. events and .log.gz
+//	{meta:key}       the request's metadata value for key
+//
+// Clock, Hostname and NewUUID override the time, hostname and UUIDs, e.g. in
+// tests.
+type TemplateKeyNameGenerator struct {
+	Template string
+	Prefix   string
+	Clock    Clock
+	Hostname string
+	NewUUID  func() string
+}
+
+// NewTemplateKeyNameGenerator returns a TemplateKeyNameGenerator for template,
+// or an error if template uses an unknown variable.
+func NewTemplateKeyNameGenerator(template, prefix string) (*TemplateKeyNameGenerator, error) {
+	for _, match := range templateVariable.FindAllStringSubmatch(template, -1) {
+		switch v := match[1]; v {
+		case "prefix", "yyyy", "mm", "dd", "hh", "host", "pid", "uuid", "basename", "name", "ext":
+		default:
+			if !strings.HasPrefix(v, "meta:") {
+				return nil, fmt.Errorf("unknown variable {%s} in key name template %q", v, template)
+			}
+		}
+	}
+	return &TemplateKeyNameGenerator{
+		Template: template,
+		Prefix:   prefix,
+	}, nil
+}
+
+// GetKeyName implements S3KeyNameGenerator.
+func (g *TemplateKeyNameGenerator) GetKeyName(filename string) string {
+	return g.GetRequestKeyName(filename, &UploadRequest{Filename: filename})
+}
+
+// GetRequestKeyName implements RequestKeyNameGenerator.
+func (g *TemplateKeyNameGenerator) GetRequestKeyName(filename string, req *UploadRequest) string {
+	now := g.Clock.now()
+	name, ext := splitExt(filename)
+	return templateVariable.ReplaceAllStringFunc(g.Template, func(match string) string {
+		switch v := match[1 : len(match)-1]; v {
+		case "prefix":
+			return g.Prefix
+		case "yyyy":
+			return now.Format("2006")
+		case "mm":
+			return now.Format("01")
+		case "dd":
+			return now.Format("02")
+		case "hh":
+			return now.Format("15")
+		case "host":
+			if g.Hostname != "" {
+				return g.Hostname
+			}
+			return hostname()
+		case "pid":
+			return strconv.Itoa(os.Getpid())
+		case "uuid":
+			if g.NewUUID != nil {
+				return g.NewUUID()
+			}
+			return uuid.NewV4().String()
+		case "basename":
+			return filepath.Base(filename)
+		case "name":
+			return name
+		case "ext":
+			return ext
+		default:
+			return req.Metadata[strings.TrimPrefix(v, "meta:")]
+		}
+	})
+}
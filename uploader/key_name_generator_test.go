@@ -0,0 +1,103 @@
+package uploader
+
+import (
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+var testClock = Clock(func() time.Time {
+	return time.Date(2017, time.June, 1, 13, 45, 0, 0, time.UTC)
+})
+
+func TestHivePartitionKeyNameGenerator(t *testing.T) {
+	g := &HivePartitionKeyNameGenerator{Prefix: "logs", Clock: testClock}
+	expected := "logs/dt=2017-06-01/hr=13/events.log.gz"
+	if actual := g.GetKeyName("/var/spool/events.log.gz"); actual != expected {
+		t.Errorf("Expected %s, got %s", expected, actual)
+	}
+}
+
+func TestUniqueKeyNameGenerator(t *testing.T) {
+	g := &UniqueKeyNameGenerator{
+		Inner: &HivePartitionKeyNameGenerator{Prefix: "logs", Clock: testClock},
+		PID:   true,
+		UUID:  true,
+	}
+	key := g.GetKeyName("/var/spool/events.log.gz")
+	pattern := `^logs/dt=2017-06-01/hr=13/events\.` + strconv.Itoa(os.Getpid()) + `\.[0-9a-f-]{36}\.log\.gz$`
+	if !regexp.MustCompile(pattern).MatchString(key) {
+		t.Errorf("Expected key matching %s, got %s", pattern, key)
+	}
+	if other := g.GetKeyName("/var/spool/events.log.gz"); other == key {
+		t.Errorf("Expected different keys for each call, got %s twice", key)
+	}
+}
+
+func TestContentHashKeyNameGenerator(t *testing.T) {
+	fn := writeTempFile(t, "hello world")
+	defer os.Remove(fn)
+
+	g := &ContentHashKeyNameGenerator{Prefix: "blobs"}
+	expected := "blobs/b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9.gz"
+	if actual := g.GetRequestKeyName(fn+".gz", &UploadRequest{Filename: fn}); actual != expected {
+		t.Errorf("Expected %s, got %s", expected, actual)
+	}
+
+	// In-memory requests are hashed rather than any file of the same name.
+	for _, req := range []*UploadRequest{
+		NewDataRequest(fn, []byte("hello world"), Text),
+		NewReaderRequest(fn, strings.NewReader("hello world"), Text),
+	} {
+		if actual := g.GetRequestKeyName(fn+".gz", req); actual != expected {
+			t.Errorf("Expected %s, got %s", expected, actual)
+		}
+	}
+	if actual := g.GetRequestKeyName(fn+".gz", NewDataRequest(fn, []byte("other"), Text)); actual == expected {
+		t.Errorf("Expected different contents to get a different key than %s", expected)
+	}
+
+	// The uploader buffers readers which can't seek so they can be hashed
+	// and still uploaded.
+	s3Uploader := &recordingS3Uploader{}
+	u := NewFactory("bucket", g, s3Uploader).NewUploader()
+	if _, err := u.Upload(NewReaderRequest("hello", io.MultiReader(strings.NewReader("hello world")), Text)); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	expected = "blobs/b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+	if key := aws.StringValue(s3Uploader.inputs[0].Key); key != expected {
+		t.Errorf("Expected %s, got %s", expected, key)
+	}
+	if body := string(s3Uploader.bodies[0]); body != "hello world" {
+		t.Errorf("Expected the whole reader to be uploaded, got %q", body)
+	}
+}
+
+func TestTemplateKeyNameGenerator(t *testing.T) {
+	if _, err := NewTemplateKeyNameGenerator("{prefix}/{bogus}", "p"); err == nil {
+		t.Errorf("Expected an error for an unknown template variable")
+	}
+
+	g, err := NewTemplateKeyNameGenerator("{prefix}/{yyyy}/{mm}/{dd}/{hh}/{meta:producer}/{host}/{name}.{uuid}{ext}", "logs")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	g.Clock = testClock
+	g.Hostname = "host1"
+	g.NewUUID = func() string { return "uuid" }
+
+	req := &UploadRequest{
+		Filename: "/var/spool/events.log",
+		Metadata: map[string]string{MetadataProducer: "spade"},
+	}
+	expected := "logs/2017/06/01/13/spade/host1/events.uuid.log.gz"
+	if actual := getKeyName(g, req.Filename+".gz", req); actual != expected {
+		t.Errorf("Expected %s, got %s", expected, actual)
+	}
+}
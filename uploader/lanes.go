@@ -0,0 +1,195 @@
+package uploader
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultLane is the lane requests are queued in if they don't name a lane,
+// or name one the pool doesn't have. It has weight 1 unless set with
+// WithLane.
+const DefaultLane = ""
+
+// DefaultStarvationTimeout is how long a request may wait at the front of its
+// lane before it is uploaded regardless of the lane weights.
+const DefaultStarvationTimeout = 30 * time.Second
+
+// WithLane adds a lane named name to the pool. When several lanes have
+// requests waiting, each lane gets a share of the free workers proportional
+// to its weight, so e.g. a lane of weight 10 has about ten requests uploaded
+// for every one from a lane of weight 1. Each lane has its own buffer of
+// WithBufferSize requests. Weights less than 1 are treated as 1.
+func WithLane(name string, weight int) PoolOption {
+	return func(p *UploaderPool) {
+		if weight < 1 {
+			weight = 1
+		}
+		p.laneWeights[name] = weight
+	}
+}
+
+// WithStarvationTimeout sets how long a request may wait at the front of its
+// lane before it is uploaded ahead of the lanes with higher weights. The
+// default is DefaultStarvationTimeout; zero disables starvation protection.
+func WithStarvationTimeout(d time.Duration) PoolOption {
+	return func(p *UploaderPool) {
+		p.starvationTimeout = d
+	}
+}
+
+// lane is a queue of requests with a scheduling weight.
+type lane struct {
+	name   string
+	weight int
+	queue  chan *UploadRequest
+	// depth is the number of requests queued in the lane, including head.
+	depth int64
+
+	// head, since, served and current are guarded by the scheduler's mutex.
+	// head is a request taken off queue but not yet scheduled, and since is
+	// when it reached the front of the lane: when it was queued, or when the
+	// request before it was scheduled at served, whichever is later. current
+	// is the lane's smooth weighted round robin credit.
+	head    *UploadRequest
+	since   time.Time
+	served  time.Time
+	current int
+}
+
+// statName is the lane's name as used in stats.
+func (l *lane) statName() string {
+	if l.name == DefaultLane {
+		return "default"
+	}
+	return l.name
+}
+
+// scheduler shares the pool's workers among its lanes.
+type scheduler struct {
+	mu         sync.Mutex
+	lanes      []*lane
+	byName     map[string]*lane
+	starvation time.Duration
+	depth      int64
+
+	// ready holds a token for every request queued and not yet scheduled,
+	// so workers can block until there is work in any lane. It is closed when
+	// the pool stops accepting requests.
+	ready chan struct{}
+}
+
+func newScheduler(weights map[string]int, bufferSize int, starvation time.Duration) *scheduler {
+	s := &scheduler{
+		byName:     make(map[string]*lane),
+		starvation: starvation,
+	}
+	if _, ok := weights[DefaultLane]; !ok {
+		weights[DefaultLane] = 1
+	}
+	for name, weight := range weights {
+		l := &lane{
+			name:   name,
+			weight: weight,
+			queue:  make(chan *UploadRequest, bufferSize),
+		}
+		s.lanes = append(s.lanes, l)
+		s.byName[name] = l
+	}
+	sort.Slice(s.lanes, func(a, b int) bool {
+		return s.lanes[a].name < s.lanes[b].name
+	})
+	// Each lane can hold its buffer plus a head.
+	s.ready = make(chan struct{}, (bufferSize+1)*len(s.lanes))
+	return s
+}
+
+// lane returns the lane named name, or the default lane.
+func (s *scheduler) lane(name string) *lane {
+	if l, ok := s.byName[name]; ok {
+		return l
+	}
+	return s.byName[DefaultLane]
+}
+
+// added records that a request was sent to l.queue.
+func (s *scheduler) added(l *lane) {
+	atomic.AddInt64(&l.depth, 1)
+	atomic.AddInt64(&s.depth, 1)
+	s.ready <- struct{}{}
+}
+
+// push queues req in its lane, blocking until there is room.
+func (s *scheduler) push(req *UploadRequest) *lane {
+	l := s.lane(req.Lane)
+	req.queuedAt = time.Now()
+	l.queue <- req
+	s.added(l)
+	return l
+}
+
+// queueDepth is the number of requests queued in all lanes.
+func (s *scheduler) queueDepth() int {
+	return int(atomic.LoadInt64(&s.depth))
+}
+
+// next blocks until a request is queued and returns it with its lane. It
+// returns false once the pool has stopped accepting requests and every lane
+// is empty, or if quit is ready first.
+//
+// Lanes are chosen by smooth weighted round robin among the lanes with
+// requests waiting, unless a lane's head has been at the front of the lane
+// for longer than the starvation timeout, in which case the lane whose head
+// has waited longest goes next. Measuring from the front of the lane rather
+// than from when requests were queued means a backlog older than the timeout
+// gets one request scheduled per timeout instead of all of them.
+func (s *scheduler) next(quit <-chan struct{}) (*UploadRequest, *lane, bool) {
+	// Every token matches a request already sent to a lane, so there is at
+	// least one request to take once we have one.
+	select {
+	case _, ok := <-s.ready:
+		if !ok {
+			return nil, nil, false
+		}
+	case <-quit:
+		return nil, nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var pick, oldest *lane
+	total := 0
+	for _, l := range s.lanes {
+		if l.head == nil {
+			select {
+			case l.head = <-l.queue:
+				l.since = l.head.queuedAt
+				if l.served.After(l.since) {
+					l.since = l.served
+				}
+			default:
+				continue
+			}
+		}
+		total += l.weight
+		l.current += l.weight
+		if pick == nil || l.current > pick.current {
+			pick = l
+		}
+		if oldest == nil || l.since.Before(oldest.since) {
+			oldest = l
+		}
+	}
+	if s.starvation > 0 && time.Since(oldest.since) >= s.starvation {
+		pick = oldest
+	}
+	pick.current -= total
+	pick.served = time.Now()
+
+	req := pick.head
+	pick.head = nil
+	atomic.AddInt64(&pick.depth, -1)
+	atomic.AddInt64(&s.depth, -1)
+	return req, pick, true
+}
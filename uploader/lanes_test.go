@@ -0,0 +1,93 @@
+package uploader
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSchedulerWeights(t *testing.T) {
+	s := newScheduler(map[string]int{"fast": 3}, 10, 0)
+	for i := 0; i < 8; i++ {
+		s.push(&UploadRequest{Filename: "bulk", Lane: "bulk"})
+		s.push(&UploadRequest{Filename: "fast", Lane: "fast"})
+	}
+	if depth := s.queueDepth(); depth != 16 {
+		t.Errorf("expected queue depth 16 but got %d", depth)
+	}
+
+	var order []string
+	for i := 0; i < 8; i++ {
+		req, l, ok := s.next(nil)
+		if !ok {
+			t.Fatal("expected a request")
+		}
+		if l != s.lane(req.Lane) {
+			t.Errorf("request for lane %q came from lane %q", req.Lane, l.name)
+		}
+		order = append(order, req.Filename)
+	}
+	// "bulk" isn't a lane, so those requests share the default lane's weight
+	// of 1 against fast's 3.
+	expected := []string{"fast", "bulk", "fast", "fast", "fast", "bulk", "fast", "fast"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("expected order %v but got %v", expected, order)
+	}
+	if depth := s.lane("bulk").depth; depth != 6 {
+		t.Errorf("expected 6 requests left in the default lane but got %d", depth)
+	}
+}
+
+func TestSchedulerStarvation(t *testing.T) {
+	s := newScheduler(map[string]int{"fast": 100}, 10, 10*time.Millisecond)
+	s.push(&UploadRequest{Filename: "bulk"})
+	time.Sleep(20 * time.Millisecond)
+	s.push(&UploadRequest{Filename: "fast1", Lane: "fast"})
+	s.push(&UploadRequest{Filename: "fast2", Lane: "fast"})
+
+	var order []string
+	for i := 0; i < 3; i++ {
+		req, _, _ := s.next(nil)
+		order = append(order, req.Filename)
+	}
+	expected := []string{"bulk", "fast1", "fast2"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("expected order %v but got %v", expected, order)
+	}
+}
+
+func TestSchedulerStarvationBacklog(t *testing.T) {
+	s := newScheduler(map[string]int{"hi": 100}, 100, 30*time.Second)
+	for i := 0; i < 50; i++ {
+		req := &UploadRequest{Filename: "bulk"}
+		s.push(req)
+		req.queuedAt = time.Now().Add(-time.Minute)
+	}
+	for i := 0; i < 10; i++ {
+		s.push(&UploadRequest{Filename: "hi", Lane: "hi"})
+	}
+
+	var order []string
+	for i := 0; i < 11; i++ {
+		req, _, _ := s.next(nil)
+		order = append(order, req.Filename)
+	}
+	// The bulk lane's head has been at the front for a minute, so it goes
+	// first, but the heads behind it have only just reached the front.
+	expected := []string{"bulk", "hi", "hi", "hi", "hi", "hi", "hi", "hi", "hi", "hi", "hi"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("expected order %v but got %v", expected, order)
+	}
+}
+
+func TestSchedulerClose(t *testing.T) {
+	s := newScheduler(map[string]int{}, 10, 0)
+	s.push(&UploadRequest{Filename: "test"})
+	close(s.ready)
+	if req, _, ok := s.next(nil); !ok || req.Filename != "test" {
+		t.Errorf("expected the queued request before closing but got %v", req)
+	}
+	if _, _, ok := s.next(nil); ok {
+		t.Error("expected no more requests after closing")
+	}
+}
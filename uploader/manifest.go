@@ -0,0 +1,272 @@
+package uploader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/twinj/uuid"
+	"github.com/twitchscience/aws_utils/common"
+	"github.com/twitchscience/aws_utils/logger"
+)
+
+const (
+	// DefaultManifestMaxFiles is how many files a manifest lists at most
+	// unless WithManifestMaxFiles says otherwise.
+	DefaultManifestMaxFiles = 1000
+	// DefaultManifestMaxAge is how long a receipt waits for its manifest
+	// unless WithManifestMaxAge says otherwise.
+	DefaultManifestMaxAge = 5 * time.Minute
+)
+
+// ErrManifestNotifierClosed is returned by ManifestNotifier.SendMessage after
+// Close.
+var ErrManifestNotifierClosed = errors.New("manifest notifier closed")
+
+// Manifest is a Redshift COPY manifest listing uploaded files.
+type Manifest struct {
+	Entries []ManifestEntry `json:"entries"`
+	// Name names the manifest when it is uploaded. It stays the same if
+	// emitting the manifest fails and is tried again.
+	Name string `json:"-"`
+	// Receipts are the receipts of the files in Entries.
+	Receipts []*UploadReceipt `json:"-"`
+}
+
+// ManifestEntry is one file in a Manifest.
+type ManifestEntry struct {
+	URL       string       `json:"url"`
+	Mandatory bool         `json:"mandatory"`
+	Meta      ManifestMeta `json:"meta"`
+}
+
+// ManifestMeta holds the metadata of a ManifestEntry. Redshift needs
+// content_length to COPY columnar formats like Parquet.
+type ManifestMeta struct {
+	ContentLength int64 `json:"content_length"`
+}
+
+// ManifestOption configures optional behavior of a ManifestNotifier.
+type ManifestOption func(*ManifestNotifier)
+
+// WithManifestMaxFiles emits a manifest once it lists n files. The default is
+// DefaultManifestMaxFiles.
+func WithManifestMaxFiles(n int) ManifestOption {
+	return func(m *ManifestNotifier) {
+		m.maxFiles = n
+	}
+}
+
+// WithManifestMaxBytes emits a manifest once its files add up to n bytes. By
+// default there is no limit.
+func WithManifestMaxBytes(n int64) ManifestOption {
+	return func(m *ManifestNotifier) {
+		m.maxBytes = n
+	}
+}
+
+// WithManifestMaxAge emits a manifest once d has passed since its first file
+// was added. The default is DefaultManifestMaxAge, and zero means no limit.
+func WithManifestMaxAge(d time.Duration) ManifestOption {
+	return func(m *ManifestNotifier) {
+		m.maxAge = d
+	}
+}
+
+// WithManifestOptionalEntries marks the files in manifests as not mandatory,
+// so COPY carries on if one is missing.
+func WithManifestOptionalEntries() ManifestOption {
+	return func(m *ManifestNotifier) {
+		m.mandatory = false
+	}
+}
+
+// ManifestNotifier is a NotifierHarness which collects receipts into Redshift
+// COPY manifests, and emits each manifest once it is big or old enough. Use
+// UploadManifests to upload the manifests to S3 and send their receipts on,
+// e.g. with an SQSReceiptNotifier.
+//
+// Receipts of skipped uploads aren't added, since their objects were already
+// there. If emitting a manifest fails, the error is logged and the manifest
+// is kept and tried again when the next threshold is reached; SendMessage
+// doesn't return the error, since the receipt it was given will still be
+// delivered. A pool started WithJournal only journals a receipt as notified
+// once its manifest has been emitted, so receipts whose manifest is never
+// emitted, e.g. because the process died, are notified again on restart.
+// Close the notifier after closing the pool, and before closing its journal,
+// to emit the last manifest.
+type ManifestNotifier struct {
+	emit      func(*Manifest) error
+	maxFiles  int
+	maxBytes  int64
+	maxAge    time.Duration
+	mandatory bool
+
+	// emitting is held while emitting, so calls to emit aren't concurrent.
+	emitting sync.Mutex
+
+	mu      sync.Mutex
+	pending *Manifest
+	bytes   int64
+	// delivered holds the delivered hooks of the pending receipts.
+	delivered []func()
+	// batch counts the manifests taken for emitting, so a timer for one
+	// manifest doesn't emit the next.
+	batch  int
+	timer  *time.Timer
+	closed bool
+}
+
+// NewManifestNotifier returns a ManifestNotifier which calls emit with each
+// manifest. Calls to emit are never concurrent.
+func NewManifestNotifier(emit func(*Manifest) error, opts ...ManifestOption) *ManifestNotifier {
+	m := &ManifestNotifier{
+		emit:      emit,
+		maxFiles:  DefaultManifestMaxFiles,
+		maxAge:    DefaultManifestMaxAge,
+		mandatory: true,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// SendMessage adds receipt's file to the pending manifest, and emits the
+// manifest if that makes it big enough. It only fails if receipt couldn't be
+// added.
+func (m *ManifestNotifier) SendMessage(receipt *UploadReceipt) error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return ErrManifestNotifierClosed
+	}
+	if !receipt.Written {
+		m.mu.Unlock()
+		return nil
+	}
+	if m.pending == nil {
+		m.pending = &Manifest{
+			Name: fmt.Sprintf("manifest-%s-%s.json", time.Now().UTC().Format("20060102T150405Z"), uuid.NewV4()),
+		}
+		m.startTimer()
+	}
+	m.pending.Entries = append(m.pending.Entries, ManifestEntry{
+		URL:       common.NormalizeS3URL(receipt.KeyName),
+		Mandatory: m.mandatory,
+		Meta:      ManifestMeta{ContentLength: receipt.Size},
+	})
+	m.pending.Receipts = append(m.pending.Receipts, receipt)
+	m.bytes += receipt.Size
+	// The receipt is only delivered once its manifest is emitted.
+	if receipt.delivered != nil {
+		m.delivered = append(m.delivered, receipt.delivered)
+		receipt.delivered = nil
+	}
+	full := (m.maxFiles > 0 && len(m.pending.Entries) >= m.maxFiles) ||
+		(m.maxBytes > 0 && m.bytes >= m.maxBytes)
+	m.mu.Unlock()
+
+	if full {
+		if err := m.flush(-1); err != nil {
+			logger.WithError(err).Error("Failed to emit manifest")
+		}
+	}
+	return nil
+}
+
+// Flush emits the pending manifest, if there is one.
+func (m *ManifestNotifier) Flush() error {
+	return m.flush(-1)
+}
+
+// Close emits the pending manifest, if there is one, and stops accepting
+// receipts.
+func (m *ManifestNotifier) Close() error {
+	m.mu.Lock()
+	m.closed = true
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+	m.mu.Unlock()
+	return m.flush(-1)
+}
+
+// startTimer arranges for the pending manifest to be emitted once it is too
+// old. The caller must hold mu.
+func (m *ManifestNotifier) startTimer() {
+	if m.maxAge <= 0 || m.closed {
+		return
+	}
+	batch := m.batch
+	m.timer = time.AfterFunc(m.maxAge, func() {
+		if err := m.flush(batch); err != nil {
+			logger.WithError(err).Error("Failed to emit manifest")
+		}
+	})
+}
+
+// flush emits the pending manifest, unless batch isn't negative and the
+// manifest isn't that batch any more. The manifest is emitted without holding
+// mu, so receipts can be added meanwhile; if emitting it fails, it is put
+// back in front of them.
+func (m *ManifestNotifier) flush(batch int) error {
+	m.emitting.Lock()
+	defer m.emitting.Unlock()
+
+	m.mu.Lock()
+	if m.pending == nil || (batch >= 0 && batch != m.batch) {
+		m.mu.Unlock()
+		return nil
+	}
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+	manifest, delivered := m.pending, m.delivered
+	m.pending, m.delivered, m.bytes = nil, nil, 0
+	m.batch++
+	m.mu.Unlock()
+
+	if err := m.emit(manifest); err != nil {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.pending != nil {
+			manifest.Entries = append(manifest.Entries, m.pending.Entries...)
+			manifest.Receipts = append(manifest.Receipts, m.pending.Receipts...)
+			delivered = append(delivered, m.delivered...)
+			if m.timer != nil {
+				m.timer.Stop()
+			}
+			m.batch++
+		}
+		m.pending, m.delivered, m.bytes = manifest, delivered, 0
+		for _, e := range manifest.Entries {
+			m.bytes += e.Meta.ContentLength
+		}
+		m.startTimer()
+		return err
+	}
+	for _, d := range delivered {
+		d()
+	}
+	return nil
+}
+
+// UploadManifests returns a function for NewManifestNotifier which uploads
+// each manifest as JSON with u, named by the manifest's Name, and sends the
+// receipt of the upload to notifier if it isn't nil.
+func UploadManifests(u Uploader, notifier NotifierHarness) func(*Manifest) error {
+	return func(manifest *Manifest) error {
+		body, err := json.Marshal(manifest)
+		if err != nil {
+			return err
+		}
+		receipt, err := u.Upload(NewDataRequest(manifest.Name, body, JSON))
+		if err != nil || notifier == nil {
+			return err
+		}
+		return notifier.SendMessage(receipt)
+	}
+}
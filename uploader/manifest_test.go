@@ -0,0 +1,216 @@
+package uploader
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// manifestRecorder keeps the manifests it is given, failing while fail is
+// set.
+type manifestRecorder struct {
+	sync.Mutex
+	manifests []*Manifest
+	fail      bool
+}
+
+func (r *manifestRecorder) emit(m *Manifest) error {
+	r.Lock()
+	defer r.Unlock()
+	if r.fail {
+		return errors.New("emit failed")
+	}
+	r.manifests = append(r.manifests, m)
+	return nil
+}
+
+func (r *manifestRecorder) urls() [][]string {
+	r.Lock()
+	defer r.Unlock()
+	var urls [][]string
+	for _, m := range r.manifests {
+		var batch []string
+		for _, e := range m.Entries {
+			batch = append(batch, e.URL)
+		}
+		urls = append(urls, batch)
+	}
+	return urls
+}
+
+func manifestReceipt(key string, size int64) *UploadReceipt {
+	return &UploadReceipt{KeyName: "bucket/" + key, Size: size, Written: true}
+}
+
+func TestManifestNotifierThresholds(t *testing.T) {
+	r := &manifestRecorder{}
+	m := NewManifestNotifier(r.emit, WithManifestMaxFiles(2), WithManifestMaxBytes(100), WithManifestMaxAge(0))
+	for _, receipt := range []*UploadReceipt{
+		manifestReceipt("a", 1),
+		{KeyName: "bucket/skipped", Size: 1},
+		manifestReceipt("b", 1),
+		manifestReceipt("c", 150),
+		manifestReceipt("d", 1),
+	} {
+		if err := m.SendMessage(receipt); err != nil {
+			t.Fatalf("Failed to add %s: %v", receipt.KeyName, err)
+		}
+	}
+	expected := [][]string{{"s3://bucket/a", "s3://bucket/b"}, {"s3://bucket/c"}}
+	if urls := r.urls(); !reflect.DeepEqual(urls, expected) {
+		t.Errorf("Expected manifests %v, got %v", expected, urls)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	expected = append(expected, []string{"s3://bucket/d"})
+	if urls := r.urls(); !reflect.DeepEqual(urls, expected) {
+		t.Errorf("Expected Close to emit the pending manifest, got %v", urls)
+	}
+	if err := m.SendMessage(manifestReceipt("e", 1)); err != ErrManifestNotifierClosed {
+		t.Errorf("Expected %v after Close, got %v", ErrManifestNotifierClosed, err)
+	}
+}
+
+func TestManifestNotifierMaxAge(t *testing.T) {
+	r := &manifestRecorder{}
+	m := NewManifestNotifier(r.emit, WithManifestMaxAge(10*time.Millisecond), WithManifestOptionalEntries())
+	defer m.Close()
+	m.SendMessage(manifestReceipt("a", 1))
+	waitFor(t, "the manifest to be emitted", func() bool { return len(r.urls()) == 1 })
+	if r.manifests[0].Entries[0].Mandatory {
+		t.Errorf("Expected optional entries")
+	}
+}
+
+func TestManifestNotifierRetry(t *testing.T) {
+	r := &manifestRecorder{fail: true}
+	m := NewManifestNotifier(r.emit, WithManifestMaxFiles(1), WithManifestMaxAge(0))
+	// The receipt is buffered, so it is still delivered even though the
+	// manifest couldn't be emitted yet.
+	if err := m.SendMessage(manifestReceipt("a", 1)); err != nil {
+		t.Errorf("Expected a to be buffered, got %v", err)
+	}
+	if err := m.Flush(); err == nil {
+		t.Errorf("Expected the emit error from Flush")
+	}
+	if urls := r.urls(); len(urls) != 0 {
+		t.Errorf("Expected no manifests yet, got %v", urls)
+	}
+
+	// The failed manifest is kept and tried again.
+	r.fail = false
+	if err := m.SendMessage(manifestReceipt("b", 1)); err != nil {
+		t.Fatalf("Failed to add b: %v", err)
+	}
+	expected := [][]string{{"s3://bucket/a", "s3://bucket/b"}}
+	if urls := r.urls(); !reflect.DeepEqual(urls, expected) {
+		t.Errorf("Expected manifests %v, got %v", expected, urls)
+	}
+}
+
+func TestManifestNotifierEmitsOutsideLock(t *testing.T) {
+	emitting := make(chan struct{})
+	release := make(chan struct{})
+	m := NewManifestNotifier(func(*Manifest) error {
+		close(emitting)
+		<-release
+		return nil
+	}, WithManifestMaxBytes(100), WithManifestMaxAge(0))
+
+	done := make(chan error)
+	go func() { done <- m.SendMessage(manifestReceipt("a", 100)) }()
+	<-emitting
+	// Receipts can be added while the last manifest is being emitted.
+	added := make(chan error)
+	go func() { added <- m.SendMessage(manifestReceipt("b", 1)) }()
+	select {
+	case err := <-added:
+		if err != nil {
+			t.Errorf("Failed to add b: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected b to be added while the manifest was emitted")
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("Failed to add a: %v", err)
+	}
+}
+
+func TestUploaderPoolManifestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest_test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	j, err := OpenJournal(filepath.Join(dir, "journal"))
+	if err != nil {
+		t.Fatalf("Error opening journal: %v", err)
+	}
+	defer j.Close()
+
+	r := &manifestRecorder{fail: true}
+	m := NewManifestNotifier(r.emit, WithManifestMaxFiles(2), WithManifestMaxAge(0))
+	pool := StartUploaderPool(1, &errorCaptureNotifier{}, m, &testUploadBuilder{}, WithJournal(j))
+	for _, fn := range []string{"test1", "test2"} {
+		pool.Upload(&UploadRequest{Filename: fn, FileType: Gzip})
+	}
+	pool.Close()
+
+	// The manifest couldn't be emitted, so its receipts must still be
+	// notified if the process dies now.
+	if _, receipts := j.Pending(); len(receipts) != 2 {
+		t.Errorf("Expected 2 receipts pending, got %v", receipts)
+	}
+	if errs := pool.ErrorNotifier.(*errorCaptureNotifier).Errors; len(errs) != 0 {
+		t.Errorf("Expected no notify errors, got %v", errs)
+	}
+
+	r.Lock()
+	r.fail = false
+	r.Unlock()
+	if err = m.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	if _, receipts := j.Pending(); len(receipts) != 0 {
+		t.Errorf("Expected the emitted receipts to be journaled as notified, got %v", receipts)
+	}
+}
+
+func TestUploadManifests(t *testing.T) {
+	s3Uploader := &recordingS3Uploader{}
+	notifier := &captureNotifier{}
+	emit := UploadManifests(NewFactory("bucket", &simpleNameGenerator{prefix: "manifests"}, s3Uploader).NewUploader(), notifier)
+	manifest := &Manifest{
+		Name: "manifest-1.json",
+		Entries: []ManifestEntry{
+			{URL: "s3://bucket/a", Mandatory: true, Meta: ManifestMeta{ContentLength: 10}},
+		},
+	}
+	if err := emit(manifest); err != nil {
+		t.Fatalf("Failed to upload manifest: %v", err)
+	}
+
+	expected := `{"entries":[{"url":"s3://bucket/a","mandatory":true,"meta":{"content_length":10}}]}`
+	if body := string(s3Uploader.bodies[0]); body != expected {
+		t.Errorf("Expected manifest %s, got %s", expected, body)
+	}
+	var decoded Manifest
+	if err := json.Unmarshal(s3Uploader.bodies[0], &decoded); err != nil || len(decoded.Entries) != 1 {
+		t.Errorf("Expected the manifest to decode, got %v", err)
+	}
+	if key := *s3Uploader.inputs[0].Key; key != "manifests/manifest-1.json" {
+		t.Errorf("Expected the manifest at manifests/manifest-1.json, got %s", key)
+	}
+	if receipts := notifier.receipts(); !reflect.DeepEqual(receipts, []string{"manifest-1.json"}) {
+		t.Errorf("Expected the manifest's receipt to be sent, got %v", receipts)
+	}
+}
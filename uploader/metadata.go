@@ -0,0 +1,101 @@
+package uploader
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Well known user metadata keys.
+const (
+	MetadataHostname      = "hostname"
+	MetadataProducer      = "producer"
+	MetadataSchemaVersion = "schema-version"
+	MetadataRecordCount   = "record-count"
+)
+
+// S3 limits on user metadata and object tags.
+const (
+	maxMetadataBytes = 2048
+	maxTags          = 10
+	maxTagKeyLength  = 128
+	maxTagValueLen   = 256
+)
+
+// validateMetadata checks metadata against S3's limits: keys must be usable
+// as HTTP header names, and the keys and values together can be at most 2KB.
+func validateMetadata(metadata map[string]string) error {
+	size := 0
+	for k, v := range metadata {
+		if k == "" {
+			return fmt.Errorf("metadata key must not be empty")
+		}
+		for _, r := range k {
+			if !isTokenRune(r) {
+				return fmt.Errorf("metadata key %q contains invalid character %q", k, r)
+			}
+		}
+		for _, r := range v {
+			if r > unicode.MaxASCII || (r < ' ' && r != '\t') {
+				return fmt.Errorf("metadata value for %q must be printable ASCII", k)
+			}
+		}
+		size += len(k) + len(v)
+	}
+	if size > maxMetadataBytes {
+		return fmt.Errorf("metadata is %d bytes, more than the limit of %d", size, maxMetadataBytes)
+	}
+	return nil
+}
+
+// isTokenRune reports whether r may appear in an HTTP header name.
+func isTokenRune(r rune) bool {
+	if r > unicode.MaxASCII || r <= ' ' {
+		return false
+	}
+	return !strings.ContainsRune(`()<>@,;:\"/[]?={}`, r)
+}
+
+// validateTags checks tags against S3's limits: at most 10 tags, keys of 1 to
+// 128 characters which don't start with "aws:", values of at most 256
+// characters, all made of letters, numbers, spaces and + - = . _ : / @.
+func validateTags(tags map[string]string) error {
+	if len(tags) > maxTags {
+		return fmt.Errorf("%d tags given, more than the limit of %d", len(tags), maxTags)
+	}
+	for k, v := range tags {
+		if n := utf8.RuneCountInString(k); n == 0 || n > maxTagKeyLength {
+			return fmt.Errorf("tag key %q must be 1 to %d characters", k, maxTagKeyLength)
+		}
+		if strings.HasPrefix(k, "aws:") {
+			return fmt.Errorf("tag key %q uses the reserved aws: prefix", k)
+		}
+		if utf8.RuneCountInString(v) > maxTagValueLen {
+			return fmt.Errorf("tag value for %q is longer than %d characters", k, maxTagValueLen)
+		}
+		for _, s := range []string{k, v} {
+			for _, r := range s {
+				if !isTagRune(r) {
+					return fmt.Errorf("tag %q contains invalid character %q", k, r)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func isTagRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.IsSpace(r) ||
+		strings.ContainsRune("+-=._:/@", r)
+}
+
+// encodeTags formats tags for the x-amz-tagging header.
+func encodeTags(tags map[string]string) string {
+	values := url.Values{}
+	for k, v := range tags {
+		values.Set(k, v)
+	}
+	return values.Encode()
+}
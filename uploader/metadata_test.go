@@ -0,0 +1,71 @@
+package uploader
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateMetadata(t *testing.T) {
+	valid := []map[string]string{
+		nil,
+		{MetadataHostname: "host-1.example.com", MetadataRecordCount: "12345"},
+		{"k": strings.Repeat("v", maxMetadataBytes-1)},
+	}
+	for _, metadata := range valid {
+		if err := validateMetadata(metadata); err != nil {
+			t.Errorf("Expected %v to be valid, got %v", metadata, err)
+		}
+	}
+
+	invalid := []map[string]string{
+		{"": "empty key"},
+		{"has space": "v"},
+		{"colon:": "v"},
+		{"k": "non-ascii é"},
+		{"k": strings.Repeat("v", maxMetadataBytes)},
+	}
+	for _, metadata := range invalid {
+		if err := validateMetadata(metadata); err == nil {
+			t.Errorf("Expected %v to be invalid", metadata)
+		}
+	}
+}
+
+func TestValidateTags(t *testing.T) {
+	valid := []map[string]string{
+		nil,
+		{"retention": "30 days", "team": "science/data@twitch"},
+		{strings.Repeat("k", maxTagKeyLength): strings.Repeat("v", maxTagValueLen)},
+	}
+	for _, tags := range valid {
+		if err := validateTags(tags); err != nil {
+			t.Errorf("Expected %v to be valid, got %v", tags, err)
+		}
+	}
+
+	tooMany := make(map[string]string)
+	for i := 0; i <= maxTags; i++ {
+		tooMany[strings.Repeat("k", i+1)] = "v"
+	}
+	invalid := []map[string]string{
+		tooMany,
+		{"": "v"},
+		{"aws:reserved": "v"},
+		{"k": "semi;colon"},
+		{strings.Repeat("k", maxTagKeyLength+1): "v"},
+		{"k": strings.Repeat("v", maxTagValueLen+1)},
+	}
+	for _, tags := range invalid {
+		if err := validateTags(tags); err == nil {
+			t.Errorf("Expected %v to be invalid", tags)
+		}
+	}
+}
+
+func TestEncodeTags(t *testing.T) {
+	actual := encodeTags(map[string]string{"team": "science", "retention": "30 days"})
+	expected := "retention=30+days&team=science"
+	if actual != expected {
+		t.Errorf("Expected %s, got %s", expected, actual)
+	}
+}
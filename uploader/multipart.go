@@ -0,0 +1,129 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/twitchscience/aws_utils/logger"
+)
+
+const (
+	// DefaultPartMemoryBudget is how much memory each upload may use for
+	// part buffers unless MultipartConfig says otherwise.
+	DefaultPartMemoryBudget = 64 * 1024 * 1024
+	// abortTimeout bounds the time spent aborting an orphaned multipart
+	// upload.
+	abortTimeout = 30 * time.Second
+)
+
+// MultipartConfig says how WithMultipartTuning picks the part size and
+// concurrency of each upload.
+type MultipartConfig struct {
+	// MemoryBudget is the most memory one upload may use for part buffers,
+	// which is its part size times its concurrency. Uploads whose smallest
+	// allowed part size is over budget are uploaded one part at a time.
+	// The default is DefaultPartMemoryBudget.
+	MemoryBudget int64
+	// MinPartSize is the smallest part size to use. The default, and the
+	// least S3 allows, is s3manager.MinUploadPartSize.
+	MinPartSize int64
+	// MaxConcurrency is the most parts of one upload to send at once. The
+	// default is s3manager.DefaultUploadConcurrency.
+	MaxConcurrency int
+
+	client s3iface.S3API
+}
+
+// WithMultipartTuning chooses the part size and concurrency of each upload
+// from the size of its file, instead of using the s3manager.Uploader's
+// settings for every file. Parts are as small as cfg allows while keeping
+// within S3's limit of s3manager.MaxUploadParts parts, and as many are sent
+// at once as cfg's memory budget allows, up to one per part. Failed multipart
+// uploads are always aborted rather than left for a retry to resume: client
+// aborts those s3manager doesn't manage to, e.g. because the upload's context
+// was canceled, so their parts aren't left behind and charged for. It panics
+// if client is nil.
+func WithMultipartTuning(client s3iface.S3API, cfg MultipartConfig) FactoryOption {
+	if client == nil {
+		panic("uploader: WithMultipartTuning needs an S3 client to abort failed uploads")
+	}
+	cfg.client = client
+	if cfg.MemoryBudget <= 0 {
+		cfg.MemoryBudget = DefaultPartMemoryBudget
+	}
+	if cfg.MinPartSize < s3manager.MinUploadPartSize {
+		cfg.MinPartSize = s3manager.MinUploadPartSize
+	}
+	if cfg.MaxConcurrency <= 0 {
+		cfg.MaxConcurrency = s3manager.DefaultUploadConcurrency
+	}
+	return func(f *factory) {
+		f.multipart = &cfg
+	}
+}
+
+// tune returns the part size and concurrency for an upload of size bytes.
+func (c *MultipartConfig) tune(size int64) (int64, int) {
+	partSize := c.MinPartSize
+	if least := (size + s3manager.MaxUploadParts - 1) / s3manager.MaxUploadParts; least > partSize {
+		partSize = least
+	}
+	parts := (size + partSize - 1) / partSize
+	concurrency := c.MaxConcurrency
+	if budget := c.MemoryBudget / partSize; budget < int64(concurrency) {
+		concurrency = int(budget)
+	}
+	if parts < int64(concurrency) {
+		concurrency = int(parts)
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return partSize, concurrency
+}
+
+// options returns the s3manager options for an upload of size bytes, which
+// is only an estimate if the upload is compressed.
+func (c *MultipartConfig) options(size int64, compressed bool) []func(*s3manager.Uploader) {
+	if c == nil {
+		return nil
+	}
+	if compressed {
+		// Incompressible data comes out slightly bigger than it went in.
+		size += size/100 + 1024
+	}
+	partSize, concurrency := c.tune(size)
+	return []func(*s3manager.Uploader){func(u *s3manager.Uploader) {
+		u.PartSize = partSize
+		u.Concurrency = concurrency
+		u.LeavePartsOnError = false
+	}}
+}
+
+// abort aborts the multipart upload err failed, in case s3manager couldn't.
+// An upload which has already been aborted can't be found, so that is
+// ignored.
+func (c *MultipartConfig) abort(input *s3manager.UploadInput, err error) {
+	var failure s3manager.MultiUploadFailure
+	if c == nil || !errors.As(err, &failure) || failure.UploadID() == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+	defer cancel()
+	_, aerr := c.client.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   input.Bucket,
+		Key:      input.Key,
+		UploadId: aws.String(failure.UploadID()),
+	})
+	if aerr != nil && errorCode(aerr) != s3.ErrCodeNoSuchUpload {
+		logger.WithError(aerr).
+			WithField("key", aws.StringValue(input.Key)).
+			WithField("upload_id", failure.UploadID()).
+			Error("Failed to abort multipart upload")
+	}
+}
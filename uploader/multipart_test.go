@@ -0,0 +1,92 @@
+package uploader
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/twitchscience/aws_utils/mocks"
+)
+
+const mb = 1024 * 1024
+
+func TestMultipartTune(t *testing.T) {
+	for _, tc := range []struct {
+		cfg         MultipartConfig
+		size        int64
+		partSize    int64
+		concurrency int
+	}{
+		{size: 1024, partSize: 5 * mb, concurrency: 1},
+		{size: 12 * mb, partSize: 5 * mb, concurrency: 3},
+		{size: 1024 * mb, partSize: 5 * mb, concurrency: 5},
+		{cfg: MultipartConfig{MaxConcurrency: 20}, size: 1024 * mb, partSize: 5 * mb, concurrency: 12},
+		{cfg: MultipartConfig{MemoryBudget: 16 * mb}, size: 1024 * mb, partSize: 5 * mb, concurrency: 3},
+		// Too big for 10,000 parts of the minimum size.
+		{size: 100 * 1024 * mb, partSize: 10737419, concurrency: 5},
+		{cfg: MultipartConfig{MemoryBudget: 16 * mb}, size: 1024 * 1024 * mb, partSize: 109951163, concurrency: 1},
+	} {
+		f := &factory{}
+		WithMultipartTuning(mocks.NewS3("bucket"), tc.cfg)(f)
+		partSize, concurrency := f.multipart.tune(tc.size)
+		if partSize != tc.partSize || concurrency != tc.concurrency {
+			t.Errorf("%+v, size %d: expected part size %d and concurrency %d, got %d and %d",
+				tc.cfg, tc.size, tc.partSize, tc.concurrency, partSize, concurrency)
+		}
+		if parts := (tc.size + partSize - 1) / partSize; parts > s3manager.MaxUploadParts {
+			t.Errorf("size %d: %d parts is over the limit", tc.size, parts)
+		}
+	}
+}
+
+func TestMultipartTuningNeedsClient(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected WithMultipartTuning to panic without a client")
+		}
+	}()
+	WithMultipartTuning(nil, MultipartConfig{})
+}
+
+func TestUploaderMultipartTuning(t *testing.T) {
+	defer noBackoff()()
+	fn := writeTempFile(t, strings.Repeat("0123456789", 1200000))
+	defer os.Remove(fn)
+
+	// Left to itself, the s3manager.Uploader would upload the file in one
+	// part.
+	bucket := mocks.NewS3("bucket")
+	s3Uploader := s3manager.NewUploaderWithClient(bucket, func(u *s3manager.Uploader) {
+		u.PartSize = 100 * mb
+	})
+	u := NewFactory("bucket", &simpleNameGenerator{prefix: "test"}, s3Uploader,
+		WithDisposer(Keep), WithMultipartTuning(bucket, MultipartConfig{})).NewUploader()
+	if _, err := u.Upload(&UploadRequest{Filename: fn, FileType: Text}); err != nil {
+		t.Fatalf("Failed to upload: %v", err)
+	}
+	if object, _ := bucket.Object("bucket", "test/"+fn); object.PartsUploaded != 3 {
+		t.Errorf("Expected a 3 part upload, got %d parts", object.PartsUploaded)
+	}
+
+	// s3manager's own attempt to abort a failed upload fails.
+	aborts := 0
+	bucket.Fault = func(op, _, _ string) error {
+		switch op {
+		case "UploadPart":
+			return requestFailure("InternalError", 500)
+		case "AbortMultipartUpload":
+			if aborts++; aborts == 1 {
+				return requestFailure("InternalError", 500)
+			}
+		}
+		return nil
+	}
+	_, err := u.Upload(&UploadRequest{Filename: fn, FileType: Text, Retry: &RetryPolicy{MaxAttempts: 1}})
+	if err == nil {
+		t.Fatal("Expected the upload to fail")
+	}
+	if n := bucket.Uploads(); n != 0 || aborts != 2 {
+		t.Errorf("Expected the failed upload to be aborted on the second try, got %d uploads left after %d tries", n, aborts)
+	}
+}
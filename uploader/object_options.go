@@ -0,0 +1,131 @@
+package uploader
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// ObjectOptions are the S3 settings given to each uploaded object. A Factory
+// has a set of defaults, configured with the FactoryOptions below, which an
+// UploadRequest can override field by field; empty fields aren't overridden.
+type ObjectOptions struct {
+	// ACL is a canned ACL, e.g. s3.ObjectCannedACLBucketOwnerFullControl.
+	ACL string
+	// ServerSideEncryption is s3.ServerSideEncryptionAes256 for SSE-S3 or
+	// s3.ServerSideEncryptionAwsKms for SSE-KMS.
+	ServerSideEncryption string
+	// SSEKMSKeyID is the KMS key to use with SSE-KMS. If empty, S3 uses the
+	// account's default key.
+	SSEKMSKeyID string
+	// StorageClass is e.g. s3.StorageClassStandardIa.
+	StorageClass    string
+	CacheControl    string
+	ContentEncoding string
+}
+
+var defaultObjectOptions = ObjectOptions{
+	ACL: s3.ObjectCannedACLBucketOwnerFullControl,
+}
+
+// merge returns o with the fields set in override replaced.
+func (o ObjectOptions) merge(override *ObjectOptions) ObjectOptions {
+	if override == nil {
+		return o
+	}
+	if override.ACL != "" {
+		o.ACL = override.ACL
+	}
+	if override.ServerSideEncryption != "" {
+		o.ServerSideEncryption = override.ServerSideEncryption
+	}
+	if override.SSEKMSKeyID != "" {
+		o.SSEKMSKeyID = override.SSEKMSKeyID
+	}
+	if override.StorageClass != "" {
+		o.StorageClass = override.StorageClass
+	}
+	if override.CacheControl != "" {
+		o.CacheControl = override.CacheControl
+	}
+	if override.ContentEncoding != "" {
+		o.ContentEncoding = override.ContentEncoding
+	}
+	return o
+}
+
+// apply sets the non-empty options on input.
+func (o ObjectOptions) apply(input *s3manager.UploadInput) {
+	input.ACL = nonEmpty(o.ACL)
+	input.ServerSideEncryption = nonEmpty(o.ServerSideEncryption)
+	input.SSEKMSKeyId = nonEmpty(o.SSEKMSKeyID)
+	input.StorageClass = nonEmpty(o.StorageClass)
+	input.CacheControl = nonEmpty(o.CacheControl)
+	input.ContentEncoding = nonEmpty(o.ContentEncoding)
+}
+
+// etagIsMD5 reports whether S3 will return the MD5 of the object as its
+// ETag, which isn't the case for objects encrypted with SSE-KMS.
+func (o ObjectOptions) etagIsMD5() bool {
+	return o.ServerSideEncryption != s3.ServerSideEncryptionAwsKms
+}
+
+func nonEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return aws.String(s)
+}
+
+// WithObjectOptions replaces the Factory's default object options.
+func WithObjectOptions(o ObjectOptions) FactoryOption {
+	return func(f *factory) {
+		f.objectOptions = o
+	}
+}
+
+// WithACL sets the canned ACL for uploaded objects. The default is
+// bucket-owner-full-control.
+func WithACL(acl string) FactoryOption {
+	return func(f *factory) {
+		f.objectOptions.ACL = acl
+	}
+}
+
+// WithSSES3 encrypts uploaded objects with S3-managed keys.
+func WithSSES3() FactoryOption {
+	return func(f *factory) {
+		f.objectOptions.ServerSideEncryption = s3.ServerSideEncryptionAes256
+		f.objectOptions.SSEKMSKeyID = ""
+	}
+}
+
+// WithSSEKMS encrypts uploaded objects with the given KMS key, or the
+// account's default key if keyID is empty.
+func WithSSEKMS(keyID string) FactoryOption {
+	return func(f *factory) {
+		f.objectOptions.ServerSideEncryption = s3.ServerSideEncryptionAwsKms
+		f.objectOptions.SSEKMSKeyID = keyID
+	}
+}
+
+// WithStorageClass sets the storage class for uploaded objects.
+func WithStorageClass(class string) FactoryOption {
+	return func(f *factory) {
+		f.objectOptions.StorageClass = class
+	}
+}
+
+// WithCacheControl sets the Cache-Control header of uploaded objects.
+func WithCacheControl(cacheControl string) FactoryOption {
+	return func(f *factory) {
+		f.objectOptions.CacheControl = cacheControl
+	}
+}
+
+// WithContentEncoding sets the Content-Encoding header of uploaded objects.
+func WithContentEncoding(encoding string) FactoryOption {
+	return func(f *factory) {
+		f.objectOptions.ContentEncoding = encoding
+	}
+}
@@ -0,0 +1,167 @@
+package uploader
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/twitchscience/aws_utils/notifier"
+)
+
+// ReceiptMessageVersion is the version of ReceiptMessage sent by
+// SQSReceiptNotifier and SNSReceiptNotifier. It is increased whenever the
+// meaning of an existing field changes; new fields may be added without a
+// new version.
+const ReceiptMessageVersion = 1
+
+// receiptMessageType is the notifier message type receipts are sent as.
+const receiptMessageType = "uploadReceipt"
+
+// ReceiptMessage is the JSON message published for each UploadReceipt.
+type ReceiptMessage struct {
+	Version     int               `json:"version"`
+	Bucket      string            `json:"bucket"`
+	Key         string            `json:"key"`
+	Size        int64             `json:"size"`
+	RawSize     int64             `json:"raw_size"`
+	MD5         string            `json:"md5,omitempty"`
+	SHA256      string            `json:"sha256,omitempty"`
+	ETag        string            `json:"etag,omitempty"`
+	VersionID   string            `json:"version_id,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+	Written     bool              `json:"written"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	// UploadedAt is the receipt's UploadedAt, and SentAt when the message
+	// was published.
+	UploadedAt time.Time `json:"uploaded_at"`
+	SentAt     time.Time `json:"sent_at"`
+	// Host is the hostname of the machine which uploaded the file.
+	Host string `json:"host"`
+}
+
+// NewReceiptMessage returns the message describing receipt, sent from host.
+func NewReceiptMessage(receipt *UploadReceipt, host string) *ReceiptMessage {
+	bucket, key := receipt.KeyName, ""
+	if i := strings.Index(receipt.KeyName, "/"); i >= 0 {
+		bucket, key = receipt.KeyName[:i], receipt.KeyName[i+1:]
+	}
+	return &ReceiptMessage{
+		Version:     ReceiptMessageVersion,
+		Bucket:      bucket,
+		Key:         key,
+		Size:        receipt.Size,
+		RawSize:     receipt.RawSize,
+		MD5:         receipt.MD5,
+		SHA256:      receipt.SHA256,
+		ETag:        receipt.ETag,
+		VersionID:   receipt.VersionID,
+		ContentType: string(receipt.ContentType),
+		Written:     receipt.Written,
+		Metadata:    receipt.Metadata,
+		Tags:        receipt.Tags,
+		UploadedAt:  receipt.UploadedAt,
+		SentAt:      time.Now(),
+		Host:        host,
+	}
+}
+
+// snsEnvelope is how SNS wraps messages it delivers to SQS queues, unless
+// raw message delivery is enabled on the subscription.
+type snsEnvelope struct {
+	Type     string
+	TopicArn string
+	Message  string
+}
+
+// DecodeReceiptMessage decodes a message sent by SQSReceiptNotifier, or by
+// SNSReceiptNotifier and delivered to an SQS queue with or without raw message
+// delivery. It returns an error for versions newer than
+// ReceiptMessageVersion.
+func DecodeReceiptMessage(body string) (*ReceiptMessage, error) {
+	var envelope snsEnvelope
+	if err := json.Unmarshal([]byte(body), &envelope); err == nil && envelope.Type == "Notification" && envelope.TopicArn != "" {
+		body = envelope.Message
+	}
+	var msg ReceiptMessage
+	if err := json.Unmarshal([]byte(body), &msg); err != nil {
+		return nil, fmt.Errorf("decoding upload receipt message: %v", err)
+	}
+	if msg.Version < 1 || msg.Version > ReceiptMessageVersion {
+		return nil, fmt.Errorf("unsupported upload receipt message version %d", msg.Version)
+	}
+	return &msg, nil
+}
+
+// ReceiptHandler is a listener.SQSHandler which decodes each message with
+// DecodeReceiptMessage and calls the function with it. Messages which can't
+// be decoded fail without calling the function.
+type ReceiptHandler func(*ReceiptMessage) error
+
+// Handle decodes msg and calls h with it.
+func (h ReceiptHandler) Handle(msg *sqs.Message) error {
+	receipt, err := DecodeReceiptMessage(aws.StringValue(msg.Body))
+	if err != nil {
+		return err
+	}
+	return h(receipt)
+}
+
+func registerReceiptMessage(m *notifier.MessageCreator, host string) {
+	m.RegisterMessageType(receiptMessageType, func(args ...interface{}) (string, error) {
+		if len(args) != 1 {
+			return "", fmt.Errorf("expected one receipt, got %d args", len(args))
+		}
+		receipt, ok := args[0].(*UploadReceipt)
+		if !ok {
+			return "", fmt.Errorf("expected an *UploadReceipt, got %T", args[0])
+		}
+		b, err := json.Marshal(NewReceiptMessage(receipt, host))
+		return string(b), err
+	})
+}
+
+// SQSReceiptNotifier is a NotifierHarness which sends a ReceiptMessage to an
+// SQS queue for each receipt.
+type SQSReceiptNotifier struct {
+	client *notifier.SQSClient
+	queue  string
+}
+
+// NewSQSReceiptNotifier returns a NotifierHarness sending receipts to the
+// queue named queue.
+func NewSQSReceiptNotifier(client sqsiface.SQSAPI, queue string) *SQSReceiptNotifier {
+	n := &SQSReceiptNotifier{client: notifier.BuildSQSClient(client), queue: queue}
+	registerReceiptMessage(n.client.Signer, hostname())
+	return n
+}
+
+// SendMessage sends receipt to the queue.
+func (n *SQSReceiptNotifier) SendMessage(receipt *UploadReceipt) error {
+	return n.client.SendMessage(receiptMessageType, n.queue, receipt)
+}
+
+// SNSReceiptNotifier is a NotifierHarness which publishes a ReceiptMessage to
+// an SNS topic for each receipt.
+type SNSReceiptNotifier struct {
+	client   *notifier.SNSClient
+	topicARN string
+}
+
+// NewSNSReceiptNotifier returns a NotifierHarness publishing receipts to the
+// topic topicARN.
+func NewSNSReceiptNotifier(client snsiface.SNSAPI, topicARN string) *SNSReceiptNotifier {
+	n := &SNSReceiptNotifier{client: notifier.BuildSNSClient(client), topicARN: topicARN}
+	registerReceiptMessage(n.client.Signer, hostname())
+	return n
+}
+
+// SendMessage publishes receipt to the topic.
+func (n *SNSReceiptNotifier) SendMessage(receipt *UploadReceipt) error {
+	return n.client.SendMessage(receiptMessageType, n.topicARN, receipt)
+}
@@ -0,0 +1,115 @@
+package uploader
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/twitchscience/aws_utils/listener"
+	"github.com/twitchscience/aws_utils/mocks"
+)
+
+var _ listener.SQSHandler = ReceiptHandler(nil)
+
+type recordingSNS struct {
+	snsiface.SNSAPI
+
+	inputs []*sns.PublishInput
+}
+
+func (r *recordingSNS) Publish(in *sns.PublishInput) (*sns.PublishOutput, error) {
+	r.inputs = append(r.inputs, in)
+	return &sns.PublishOutput{}, nil
+}
+
+var testReceipt = &UploadReceipt{
+	Path:        "/spool/events.log",
+	KeyName:     "bucket/logs/events.log.gz",
+	Size:        10,
+	RawSize:     20,
+	MD5:         "5eb63bbbe01eeed093cb22bb8f5acdc3",
+	ETag:        "5eb63bbbe01eeed093cb22bb8f5acdc3",
+	ContentType: Gzip,
+	UploadedAt:  time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	Written:     true,
+	Metadata:    map[string]string{MD5MetadataKey: "5eb63bbbe01eeed093cb22bb8f5acdc3"},
+}
+
+func checkReceiptMessage(t *testing.T, msg *ReceiptMessage) {
+	if msg.SentAt.IsZero() || msg.Host == "" {
+		t.Errorf("Expected the message to say when and where it was sent from, got %+v", msg)
+	}
+	msg.SentAt, msg.Host = time.Time{}, ""
+	expected := &ReceiptMessage{
+		Version:     ReceiptMessageVersion,
+		Bucket:      "bucket",
+		Key:         "logs/events.log.gz",
+		Size:        10,
+		RawSize:     20,
+		MD5:         testReceipt.MD5,
+		ETag:        testReceipt.ETag,
+		ContentType: "application/x-gzip",
+		Written:     true,
+		Metadata:    testReceipt.Metadata,
+		UploadedAt:  testReceipt.UploadedAt,
+	}
+	if !reflect.DeepEqual(msg, expected) {
+		t.Errorf("Expected message %+v, got %+v", expected, msg)
+	}
+}
+
+func TestSQSReceiptNotifier(t *testing.T) {
+	client := &mocks.SQS{}
+	if err := NewSQSReceiptNotifier(client, "receipts").SendMessage(testReceipt); err != nil {
+		t.Fatalf("Failed to send receipt: %v", err)
+	}
+
+	var handled *ReceiptMessage
+	handler := ReceiptHandler(func(msg *ReceiptMessage) error {
+		handled = msg
+		return nil
+	})
+	if err := handler.Handle(&sqs.Message{Body: aws.String(client.LastSent())}); err != nil {
+		t.Fatalf("Failed to handle receipt: %v", err)
+	}
+	checkReceiptMessage(t, handled)
+}
+
+func TestSNSReceiptNotifier(t *testing.T) {
+	client := &recordingSNS{}
+	if err := NewSNSReceiptNotifier(client, "arn:aws:sns:us-west-2:123456789012:receipts").SendMessage(testReceipt); err != nil {
+		t.Fatalf("Failed to publish receipt: %v", err)
+	}
+	if len(client.inputs) != 1 || aws.StringValue(client.inputs[0].TopicArn) != "arn:aws:sns:us-west-2:123456789012:receipts" {
+		t.Fatalf("Expected one message published to the topic, got %v", client.inputs)
+	}
+
+	// Without raw message delivery, SQS subscribers get the message wrapped
+	// in an envelope.
+	envelope, _ := json.Marshal(map[string]string{
+		"Type":      "Notification",
+		"MessageId": "1",
+		"TopicArn":  "arn:aws:sns:us-west-2:123456789012:receipts",
+		"Message":   aws.StringValue(client.inputs[0].Message),
+	})
+	for _, body := range []string{aws.StringValue(client.inputs[0].Message), string(envelope)} {
+		msg, err := DecodeReceiptMessage(body)
+		if err != nil {
+			t.Fatalf("Failed to decode %s: %v", body, err)
+		}
+		checkReceiptMessage(t, msg)
+	}
+}
+
+func TestDecodeReceiptMessageVersion(t *testing.T) {
+	for _, body := range []string{`{"version":2,"bucket":"b"}`, `{"bucket":"b"}`, `not json`} {
+		if msg, err := DecodeReceiptMessage(body); err == nil {
+			t.Errorf("Expected an error decoding %s, got %+v", body, msg)
+		}
+	}
+}
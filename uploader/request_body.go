@@ -0,0 +1,130 @@
+package uploader
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// bodySource is where an UploadRequest's contents come from.
+type bodySource int
+
+const (
+	fromFile bodySource = iota
+	fromData
+	fromReader
+)
+
+// NewDataRequest returns a request to upload data as an object named by
+// name. Nil or empty data uploads an empty object.
+func NewDataRequest(name string, data []byte, fileType FileTypeHeader) *UploadRequest {
+	return &UploadRequest{Filename: name, Data: data, FileType: fileType, source: fromData}
+}
+
+// NewReaderRequest returns a request to upload what r holds as an object
+// named by name.
+func NewReaderRequest(name string, r io.Reader, fileType FileTypeHeader) *UploadRequest {
+	return &UploadRequest{Filename: name, Reader: r, FileType: fileType, source: fromReader}
+}
+
+// kind returns where r's contents come from. Requests built without a
+// constructor are in memory if Data or Reader is set.
+func (r *UploadRequest) kind() bodySource {
+	switch {
+	case r.Reader != nil:
+		return fromReader
+	case r.Data != nil, r.source == fromData:
+		return fromData
+	case r.source == fromReader:
+		// A reader request whose Reader is nil has nothing to upload.
+		return fromData
+	}
+	return fromFile
+}
+
+// isFile reports whether req uploads a local file rather than data in
+// memory.
+func (r *UploadRequest) isFile() bool {
+	return r.kind() == fromFile
+}
+
+// requestBody is what an upload reads from.
+type requestBody interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// memoryBody is a requestBody held in memory. It keeps bytes.Reader's ReadAt
+// method so s3manager doesn't buffer it again.
+type memoryBody struct {
+	*bytes.Reader
+}
+
+func (memoryBody) Close() error { return nil }
+
+// seekerBody adapts a caller's ReadSeeker, which the caller closes.
+type seekerBody struct {
+	io.ReadSeeker
+}
+
+func (seekerBody) Close() error { return nil }
+
+// open returns the body to upload for r and its size. A Reader which can't
+// seek is read into memory and replaced with one which can.
+func (r *UploadRequest) open() (requestBody, int64, error) {
+	switch r.kind() {
+	case fromData:
+		return memoryBody{bytes.NewReader(r.Data)}, int64(len(r.Data)), nil
+	case fromReader:
+		if rs, ok := r.Reader.(io.ReadSeeker); ok {
+			size, err := rs.Seek(0, io.SeekEnd)
+			if err != nil {
+				return nil, 0, err
+			}
+			if _, err = rs.Seek(0, io.SeekStart); err != nil {
+				return nil, 0, err
+			}
+			return seekerBody{rs}, size, nil
+		}
+		data, err := ioutil.ReadAll(r.Reader)
+		if err != nil {
+			return nil, 0, err
+		}
+		// Keep the buffered contents, since the reader can't be read
+		// again, e.g. to name the object after them.
+		body := bytes.NewReader(data)
+		r.Reader = body
+		return memoryBody{body}, int64(len(data)), nil
+	}
+	f, err := os.Open(r.Filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+// buffered returns r, or if r has a Reader, a copy of r with the reader's
+// contents in Data so that it can be uploaded several times at once.
+func (r *UploadRequest) buffered() (*UploadRequest, error) {
+	if r.Reader == nil {
+		return r, nil
+	}
+	if rs, ok := r.Reader.(io.Seeker); ok {
+		if _, err := rs.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+	data, err := ioutil.ReadAll(r.Reader)
+	if err != nil {
+		return nil, err
+	}
+	b := *r
+	b.Data, b.Reader, b.source = data, nil, fromData
+	return &b, nil
+}
@@ -0,0 +1,249 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// ErrorClass says whether an upload which failed with an error is worth
+// trying again.
+type ErrorClass int
+
+const (
+	// Retryable errors may succeed if the upload is tried again.
+	Retryable ErrorClass = iota
+	// Permanent errors, like AccessDenied or NoSuchBucket, will fail again,
+	// so the upload isn't retried.
+	Permanent
+	// Throttled errors mean S3 asked for requests to slow down. They are
+	// retried after the policy's ThrottleBackoff.
+	Throttled
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case Permanent:
+		return "permanent"
+	case Throttled:
+		return "throttled"
+	default:
+		return "retryable"
+	}
+}
+
+// permanentCodes are AWS error codes which no amount of retrying will fix.
+var permanentCodes = map[string]bool{
+	"AccessDenied":          true,
+	"AccountProblem":        true,
+	"AllAccessDisabled":     true,
+	"EntityTooLarge":        true,
+	"InvalidAccessKeyId":    true,
+	"InvalidArgument":       true,
+	"InvalidBucketName":     true,
+	"InvalidObjectState":    true,
+	"InvalidRequest":        true,
+	"InvalidStorageClass":   true,
+	"KMS.DisabledException": true,
+	"KMS.NotFoundException": true,
+	"MethodNotAllowed":      true,
+	"NoSuchBucket":          true,
+	"NotImplemented":        true,
+	"SignatureDoesNotMatch": true,
+	"UnauthorizedAccess":    true,
+}
+
+// retryableCodes are AWS error codes with a 4xx status which are still worth
+// retrying, since they are caused by the request rather than its target.
+var retryableCodes = map[string]bool{
+	"BadDigest":            true,
+	"ExpiredToken":         true,
+	"IncompleteBody":       true,
+	"RequestTimeTooSkewed": true,
+	"RequestTimeout":       true,
+	"InvalidPart":          true,
+	"NoSuchUpload":         true,
+}
+
+// awsError returns the innermost AWS error in err's chain, preferring one
+// with an HTTP status, or nil if there is none. s3manager wraps the errors of
+// multipart uploads in its own.
+func awsError(err error) awserr.Error {
+	var found awserr.Error
+	for err != nil {
+		aerr, ok := err.(awserr.Error)
+		if !ok {
+			if multi, ok := err.(interface{ Unwrap() []error }); ok {
+				for _, e := range multi.Unwrap() {
+					if aerr := awsError(e); aerr != nil {
+						return aerr
+					}
+				}
+				return found
+			}
+			err = errors.Unwrap(err)
+			continue
+		}
+		if _, ok := aerr.(awserr.RequestFailure); ok {
+			return aerr
+		}
+		if found == nil {
+			found = aerr
+		}
+		err = aerr.OrigErr()
+	}
+	return found
+}
+
+// errorCode returns the AWS error code of err, or "" if it has none.
+func errorCode(err error) string {
+	if aerr := awsError(err); aerr != nil {
+		return aerr.Code()
+	}
+	return ""
+}
+
+// ClassifyError returns the class of an error from an upload, going by its
+// AWS error code and HTTP status. Errors which aren't from AWS, like network
+// errors and checksum mismatches, are Retryable.
+func ClassifyError(err error) ErrorClass {
+	aerr := awsError(err)
+	if aerr == nil {
+		return Retryable
+	}
+	code := aerr.Code()
+	if request.IsErrorThrottle(aerr) || code == "SlowDown" {
+		return Throttled
+	}
+	if permanentCodes[code] {
+		return Permanent
+	}
+	if reqErr, ok := aerr.(awserr.RequestFailure); ok && !retryableCodes[code] {
+		switch status := reqErr.StatusCode(); {
+		case status == http.StatusTooManyRequests:
+			return Throttled
+		case status == http.StatusRequestTimeout:
+			return Retryable
+		case status >= 400 && status < 500:
+			return Permanent
+		}
+	}
+	return Retryable
+}
+
+// RetryPolicy says how many times, and how often, an upload is tried. Zero
+// fields take their values from the Factory's policy, which in turn defaults
+// to DefaultRetryPolicy.
+type RetryPolicy struct {
+	// MaxAttempts is how many times the upload is tried in all.
+	MaxAttempts int
+	// Backoff is how long to wait after the first failed attempt. Each
+	// wait is Backoff longer than the one before.
+	Backoff time.Duration
+	// ThrottleBackoff is used instead of Backoff after Throttled errors.
+	ThrottleBackoff time.Duration
+	// Classify decides which errors are retried. It defaults to
+	// ClassifyError.
+	Classify func(error) ErrorClass `json:"-"`
+}
+
+// DefaultRetryPolicy is the retry policy used unless one is given with
+// WithRetryPolicy or UploadRequest.Retry.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:     3,
+	Backoff:         2 * time.Second,
+	ThrottleBackoff: 5 * time.Second,
+	Classify:        ClassifyError,
+}
+
+// WithRetryPolicy sets the Factory's retry policy. Zero fields of p take
+// their values from DefaultRetryPolicy.
+func WithRetryPolicy(p RetryPolicy) FactoryOption {
+	return func(f *factory) {
+		f.retry = f.retry.merge(&p)
+	}
+}
+
+// merge returns p with the non-zero fields of override, if any, replacing
+// its own.
+func (p RetryPolicy) merge(override *RetryPolicy) RetryPolicy {
+	if override == nil {
+		return p
+	}
+	if override.MaxAttempts > 0 {
+		p.MaxAttempts = override.MaxAttempts
+	}
+	if override.Backoff > 0 {
+		p.Backoff = override.Backoff
+	}
+	if override.ThrottleBackoff > 0 {
+		p.ThrottleBackoff = override.ThrottleBackoff
+	}
+	if override.Classify != nil {
+		p.Classify = override.Classify
+	}
+	return p
+}
+
+// RetryError is returned when an upload fails, either because it ran out of
+// attempts or because its error was Permanent.
+type RetryError struct {
+	// Attempts is how many times the upload was tried.
+	Attempts int
+	// Class is the class of Err.
+	Class ErrorClass
+	// Err is the error from the last attempt.
+	Err error
+}
+
+func (e *RetryError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the error from the last attempt.
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// retry calls fn until it succeeds, it returns a Permanent error, or the
+// policy's attempts run out, and returns how many times fn was called. Failures
+// are returned as a *RetryError, except that ctx.Err() is returned as it is if
+// ctx is done first.
+func (p RetryPolicy) retry(ctx context.Context, fn func() error) (int, error) {
+	classify := p.Classify
+	if classify == nil {
+		classify = ClassifyError
+	}
+	for attempt := 1; ; attempt++ {
+		if ctx.Err() != nil {
+			return attempt - 1, ctx.Err()
+		}
+		err := fn()
+		if err == nil {
+			return attempt, nil
+		}
+		if ctx.Err() != nil {
+			return attempt, ctx.Err()
+		}
+		class := classify(err)
+		if class == Permanent || attempt >= p.MaxAttempts {
+			return attempt, &RetryError{Attempts: attempt, Class: class, Err: err}
+		}
+
+		backoff := p.Backoff
+		if class == Throttled {
+			backoff = p.ThrottleBackoff
+		}
+		t := time.NewTimer(time.Duration(attempt) * backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return attempt, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
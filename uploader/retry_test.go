@@ -0,0 +1,95 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/twitchscience/aws_utils/mocks"
+)
+
+func requestFailure(code string, status int) error {
+	return awserr.NewRequestFailure(awserr.New(code, code, nil), status, "")
+}
+
+func TestClassifyError(t *testing.T) {
+	for _, tc := range []struct {
+		err   error
+		class ErrorClass
+	}{
+		{errors.New("connection reset"), Retryable},
+		{&ChecksumMismatchError{}, Retryable},
+		{requestFailure("InternalError", 500), Retryable},
+		{requestFailure("RequestTimeout", 400), Retryable},
+		{requestFailure("BadDigest", 400), Retryable},
+		{requestFailure("AccessDenied", 403), Permanent},
+		{requestFailure("NoSuchBucket", 404), Permanent},
+		{requestFailure("SomethingNew", 400), Permanent},
+		{requestFailure("SlowDown", 503), Throttled},
+		{requestFailure("Throttling", 400), Throttled},
+		{requestFailure("", 429), Throttled},
+		{awserr.New("MultipartUpload", "upload multipart failed", requestFailure("AccessDenied", 403)), Permanent},
+		{awserr.New("RequestError", "send request failed", errors.New("dial tcp: i/o timeout")), Retryable},
+	} {
+		if class := ClassifyError(tc.err); class != tc.class {
+			t.Errorf("Expected %v to be %v, got %v", tc.err, tc.class, class)
+		}
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 4, Backoff: time.Hour, ThrottleBackoff: time.Millisecond}
+	calls := 0
+	attempts, err := policy.retry(context.Background(), func() error {
+		calls++
+		return requestFailure("SlowDown", 503)
+	})
+	if calls != 4 || attempts != 4 {
+		t.Errorf("Expected throttled errors to be tried 4 times with the throttle backoff, got %d", calls)
+	}
+	if retryErr, ok := err.(*RetryError); !ok || retryErr.Class != Throttled || retryErr.Attempts != 4 {
+		t.Errorf("Expected a throttled RetryError, got %#v", err)
+	}
+
+	merged := DefaultRetryPolicy.merge(&RetryPolicy{MaxAttempts: 7})
+	if merged.MaxAttempts != 7 || merged.Backoff != DefaultRetryPolicy.Backoff || merged.Classify == nil {
+		t.Errorf("Expected only MaxAttempts to be overridden, got %+v", merged)
+	}
+}
+
+func TestUploaderRetryPolicy(t *testing.T) {
+	defer noBackoff()()
+	fn := writeTempFile(t, "hello world")
+	defer os.Remove(fn)
+
+	// The bucket doesn't exist, which retrying won't fix.
+	bucket := mocks.NewS3()
+	u := NewFactory("missing", &simpleNameGenerator{prefix: "test"}, s3manager.NewUploaderWithClient(bucket),
+		WithDisposer(Keep), WithRetryPolicy(RetryPolicy{MaxAttempts: 5})).NewUploader()
+	_, err := u.Upload(&UploadRequest{Filename: fn, FileType: Text})
+	if retryErr, ok := err.(*RetryError); !ok || retryErr.Attempts != 1 || retryErr.Class != Permanent {
+		t.Errorf("Expected a permanent RetryError after 1 attempt, got %#v", err)
+	}
+	if calls := bucket.Calls("PutObject"); calls != 1 {
+		t.Errorf("Expected 1 PutObject call, got %d", calls)
+	}
+
+	// Requests can override the Factory's policy.
+	bucket = mocks.NewS3("bucket")
+	bucket.Fault = func(op, _, _ string) error {
+		return requestFailure("InternalError", 500)
+	}
+	u = NewFactory("bucket", &simpleNameGenerator{prefix: "test"}, s3manager.NewUploaderWithClient(bucket),
+		WithDisposer(Keep), WithRetryPolicy(RetryPolicy{MaxAttempts: 5})).NewUploader()
+	_, err = u.Upload(&UploadRequest{Filename: fn, FileType: Text, Retry: &RetryPolicy{MaxAttempts: 2}})
+	if retryErr, ok := err.(*RetryError); !ok || retryErr.Attempts != 2 || retryErr.Class != Retryable {
+		t.Errorf("Expected a RetryError after 2 attempts, got %#v", err)
+	}
+	if calls := bucket.Calls("PutObject"); calls != 2 {
+		t.Errorf("Expected 2 PutObject calls, got %d", calls)
+	}
+}
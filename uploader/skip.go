@@ -0,0 +1,168 @@
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/twinj/uuid"
+)
+
+// MismatchPolicy says what to do when an object already exists at the key
+// being uploaded to, but its contents differ.
+type MismatchPolicy int
+
+const (
+	// OverwriteMismatched uploads over the existing object.
+	OverwriteMismatched MismatchPolicy = iota
+	// FailMismatched fails the upload with an *ObjectExistsError.
+	FailMismatched
+	// RenameMismatched uploads to a new key instead, made by adding a
+	// checksum of the file before the key's extension.
+	RenameMismatched
+)
+
+// ObjectExistsError is returned when a different object already exists at the
+// key being uploaded to and the MismatchPolicy is FailMismatched.
+type ObjectExistsError struct {
+	Bucket string
+	Key    string
+}
+
+func (e *ObjectExistsError) Error() string {
+	return fmt.Sprintf("a different object already exists at s3://%s/%s", e.Bucket, e.Key)
+}
+
+type skipIdentical struct {
+	client s3iface.S3API
+	policy MismatchPolicy
+}
+
+// WithSkipIdentical checks the destination of each upload with a HEAD request
+// using client, and skips the upload if an object with the same size and
+// checksum is already there, returning a receipt with Written false. If the
+// object exists but differs, policy decides what happens.
+//
+// Objects are compared using the checksums in their metadata, or for single
+// part uploads their ETag, so checksums mustn't be disabled with
+// WithChecksums. Compressed uploads don't store their checksums in metadata,
+// so they can't be compared reliably and fail instead; see WithCompression.
+func WithSkipIdentical(client s3iface.S3API, policy MismatchPolicy) FactoryOption {
+	return func(f *factory) {
+		f.skip = &skipIdentical{client: client, policy: policy}
+	}
+}
+
+// checkExisting looks for an object already at input's key. It returns the
+// object's details if it is identical to the file sums are the checksums of
+// and the upload should be skipped, and nil otherwise, after changing input's
+// key if the upload should go elsewhere.
+func (worker *uploader) checkExisting(
+	ctx context.Context,
+	retry RetryPolicy,
+	input *s3manager.UploadInput,
+	sums *checksummer,
+	objectOptions ObjectOptions,
+) (*s3.HeadObjectOutput, error) {
+	head, err := worker.head(ctx, retry, input)
+	if err != nil || head == nil {
+		return nil, err
+	}
+	if identical(head, sums, objectOptions.etagIsMD5()) {
+		return head, nil
+	}
+
+	switch worker.skip.policy {
+	case FailMismatched:
+		return nil, &ObjectExistsError{
+			Bucket: aws.StringValue(input.Bucket),
+			Key:    aws.StringValue(input.Key),
+		}
+	case RenameMismatched:
+		input.Key = aws.String(renameKey(aws.StringValue(input.Key), sums))
+		// The renamed object may be there from an earlier run.
+		if head, err = worker.head(ctx, retry, input); err != nil || head == nil {
+			return nil, err
+		}
+		if identical(head, sums, objectOptions.etagIsMD5()) {
+			return head, nil
+		}
+	}
+	return nil, nil
+}
+
+// head returns the object at input's key, or nil if there isn't one.
+func (worker *uploader) head(ctx context.Context, retry RetryPolicy, input *s3manager.UploadInput) (*s3.HeadObjectOutput, error) {
+	var head *s3.HeadObjectOutput
+	_, err := retry.retry(ctx, func() error {
+		var e error
+		head, e = worker.skip.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: input.Bucket,
+			Key:    input.Key,
+		})
+		if reqErr, ok := e.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusNotFound {
+			head = nil
+			return nil
+		}
+		return e
+	})
+	return head, err
+}
+
+// identical reports whether head describes an object with the given size and
+// checksums. Objects which can't be compared aren't identical.
+func identical(head *s3.HeadObjectOutput, sums *checksummer, etagIsMD5 bool) bool {
+	if aws.Int64Value(head.ContentLength) != sums.size {
+		return false
+	}
+	metadata := lowerKeys(aws.StringValueMap(head.Metadata))
+	if md5sum := sums.MD5(); md5sum != "" {
+		if stored, ok := metadata[MD5MetadataKey]; ok {
+			return strings.EqualFold(stored, md5sum)
+		}
+		etag := strings.Trim(aws.StringValue(head.ETag), `"`)
+		if etagIsMD5 && etag != "" && !strings.Contains(etag, "-") {
+			return strings.EqualFold(etag, md5sum)
+		}
+	}
+	if sha256sum := sums.SHA256(); sha256sum != "" {
+		if stored, ok := metadata[SHA256MetadataKey]; ok {
+			return strings.EqualFold(stored, sha256sum)
+		}
+	}
+	return false
+}
+
+// renameKey adds a checksum, or failing that a UUID, before key's extension.
+func renameKey(key string, sums *checksummer) string {
+	suffix := sums.MD5()
+	if suffix == "" {
+		suffix = sums.SHA256()
+	}
+	if suffix == "" {
+		suffix = uuid.NewV4().String()
+	}
+	dir, base := path.Split(key)
+	name, ext := splitExt(base)
+	return dir + name + "." + suffix + ext
+}
+
+// lowerKeys returns m with its keys lowercased. S3 returns metadata keys
+// canonicalized as HTTP headers, e.g. Md5.
+func lowerKeys(m map[string]string) map[string]string {
+	if len(m) == 0 {
+		return nil
+	}
+	lower := make(map[string]string, len(m))
+	for k, v := range m {
+		lower[strings.ToLower(k)] = v
+	}
+	return lower
+}
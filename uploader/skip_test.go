@@ -0,0 +1,144 @@
+package uploader
+
+import (
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// headS3 answers HEAD requests from objects, keyed by bucket/key.
+type headS3 struct {
+	s3iface.S3API
+	objects map[string]*s3.HeadObjectOutput
+}
+
+func (h *headS3) HeadObjectWithContext(ctx aws.Context, in *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	if head, ok := h.objects[aws.StringValue(in.Bucket)+"/"+aws.StringValue(in.Key)]; ok {
+		return head, nil
+	}
+	return nil, awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), http.StatusNotFound, "")
+}
+
+func TestUploaderSkipIdentical(t *testing.T) {
+	fn := writeTempFile(t, "hello world")
+	defer os.Remove(fn)
+	const helloMD5 = "5eb63bbbe01eeed093cb22bb8f5acdc3"
+	key := "bucket/test/" + fn
+	// The temp file has no extension, so the checksum goes on the end.
+	renamed := key + "." + helloMD5
+
+	for _, tc := range []struct {
+		name     string
+		existing *s3.HeadObjectOutput
+		policy   MismatchPolicy
+		written  bool
+		key      string
+		failed   bool
+	}{
+		{name: "missing", written: true, key: key},
+		{
+			name: "identical metadata",
+			existing: &s3.HeadObjectOutput{
+				ContentLength: aws.Int64(11),
+				ETag:          aws.String(`"abc-2"`),
+				Metadata:      map[string]*string{"Md5": aws.String(helloMD5)},
+			},
+			key: key,
+		},
+		{
+			name:     "identical etag",
+			existing: &s3.HeadObjectOutput{ContentLength: aws.Int64(11), ETag: aws.String(`"` + helloMD5 + `"`)},
+			key:      key,
+		},
+		{
+			name:     "overwrite",
+			existing: &s3.HeadObjectOutput{ContentLength: aws.Int64(12)},
+			policy:   OverwriteMismatched,
+			written:  true,
+			key:      key,
+		},
+		{
+			name:     "fail",
+			existing: &s3.HeadObjectOutput{ContentLength: aws.Int64(12)},
+			policy:   FailMismatched,
+			failed:   true,
+		},
+		{
+			name:     "rename",
+			existing: &s3.HeadObjectOutput{ContentLength: aws.Int64(11), ETag: aws.String(`"different"`)},
+			policy:   RenameMismatched,
+			written:  true,
+			key:      renamed,
+		},
+	} {
+		client := &headS3{objects: map[string]*s3.HeadObjectOutput{}}
+		if tc.existing != nil {
+			client.objects[key] = tc.existing
+		}
+		s3Uploader := &recordingS3Uploader{}
+		u := NewFactory("bucket", &simpleNameGenerator{prefix: "test"}, s3Uploader,
+			WithSkipIdentical(client, tc.policy), WithDisposer(Keep)).NewUploader()
+		receipt, err := u.Upload(&UploadRequest{Filename: fn, FileType: Text})
+		if tc.failed {
+			if _, ok := err.(*ObjectExistsError); !ok {
+				t.Errorf("%s: expected an ObjectExistsError but got %v", tc.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: upload failed: %v", tc.name, err)
+		}
+		if receipt.Written != tc.written || receipt.KeyName != tc.key {
+			t.Errorf("%s: expected written=%v to %s but got written=%v to %s",
+				tc.name, tc.written, tc.key, receipt.Written, receipt.KeyName)
+		}
+		if uploads := len(s3Uploader.inputs); tc.written != (uploads == 1) {
+			t.Errorf("%s: expected written=%v but %d uploads were made", tc.name, tc.written, uploads)
+		}
+		if receipt.MD5 != helloMD5 || receipt.Size != 11 {
+			t.Errorf("%s: expected checksums in receipt but got %+v", tc.name, receipt)
+		}
+	}
+}
+
+func TestUploaderSkipIdenticalCompressed(t *testing.T) {
+	fn := writeTempFile(t, "hello world")
+	defer os.Remove(fn)
+	client := &headS3{objects: map[string]*s3.HeadObjectOutput{}}
+	s3Uploader := &recordingS3Uploader{}
+	// Compressed by the factory, and by the request.
+	for _, tc := range []struct {
+		u           Uploader
+		compression Compression
+	}{
+		{u: NewFactory("bucket", &simpleNameGenerator{prefix: "test"}, s3Uploader,
+			WithSkipIdentical(client, OverwriteMismatched), WithCompression(GzipCompression), WithDisposer(Keep)).NewUploader()},
+		{u: NewFactory("bucket", &simpleNameGenerator{prefix: "test"}, s3Uploader,
+			WithSkipIdentical(client, OverwriteMismatched), WithDisposer(Keep)).NewUploader(), compression: ZstdCompression},
+	} {
+		if _, err := tc.u.Upload(&UploadRequest{Filename: fn, FileType: Text, Compression: tc.compression}); err == nil {
+			t.Error("Expected compressed uploads to fail with WithSkipIdentical")
+		}
+	}
+	if len(s3Uploader.inputs) != 0 {
+		t.Errorf("Expected nothing to be uploaded, got %d uploads", len(s3Uploader.inputs))
+	}
+	if _, err := os.Stat(fn); err != nil {
+		t.Errorf("Expected the file to be kept, got %v", err)
+	}
+}
+
+func TestRenameKey(t *testing.T) {
+	sums := newChecksummer(ChecksumSHA256)
+	sums.Write([]byte("hello world"))
+	expected := "logs/events.b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9.log.gz"
+	if key := renameKey("logs/events.log.gz", sums); key != expected {
+		t.Errorf("expected %s but got %s", expected, key)
+	}
+}
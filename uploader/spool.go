@@ -0,0 +1,233 @@
+package uploader
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/twitchscience/aws_utils/logger"
+)
+
+// DefaultSpoolPollInterval is how often a SpoolWatcher rescans its
+// directories.
+const DefaultSpoolPollInterval = time.Second
+
+// SpoolRule decides which files in a spooled directory are uploaded, and
+// when a file is complete enough to upload.
+type SpoolRule struct {
+	// Pattern is matched against the file's base name with filepath.Match.
+	Pattern string
+	// FileType and Lane are set on the file's UploadRequest.
+	FileType FileTypeHeader
+	Lane     string
+	// MinAge is how long ago the file must have last been modified.
+	MinAge time.Duration
+	// StableFor is how long the file's size and modification time must be
+	// seen unchanged. Since files are checked every poll interval, a file
+	// is always seen at least twice if this is positive.
+	StableFor time.Duration
+}
+
+// SpoolOption configures optional behavior of a SpoolWatcher.
+type SpoolOption func(*SpoolWatcher)
+
+// WithSpoolPollInterval sets how often the directories are rescanned. The
+// default is DefaultSpoolPollInterval. Where inotify is used, the directories
+// are also rescanned whenever they change.
+func WithSpoolPollInterval(d time.Duration) SpoolOption {
+	return func(w *SpoolWatcher) {
+		w.pollInterval = d
+	}
+}
+
+// WithSpoolPolling turns off inotify, e.g. for network filesystems where it
+// doesn't report changes made by other hosts.
+func WithSpoolPolling() SpoolOption {
+	return func(w *SpoolWatcher) {
+		w.polling = true
+	}
+}
+
+// SpoolWatcher watches directories that producers write finished files into,
+// and queues each complete file in an UploaderPool once. Files which are
+// already there when it starts are queued too.
+//
+// On Linux the directories are watched with inotify so new files are noticed
+// straight away; elsewhere, or with WithSpoolPolling, they are only rescanned
+// every poll interval. Each file is matched against the rules in order, and
+// files no rule matches are ignored.
+type SpoolWatcher struct {
+	pool         *UploaderPool
+	dirs         []string
+	rules        []SpoolRule
+	pollInterval time.Duration
+	polling      bool
+
+	// files tracks the files seen in the last scan. Submitted files are kept
+	// so they aren't queued again while they are still there.
+	files map[string]*spoolFile
+
+	watcher dirWatcher
+	stop    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+type spoolFile struct {
+	info      os.FileInfo
+	since     time.Time
+	submitted bool
+}
+
+// dirWatcher reports changes to a set of directories.
+type dirWatcher interface {
+	// Events gets a value when the directories may have changed.
+	Events() <-chan struct{}
+	Close() error
+}
+
+// StartSpoolWatcher starts watching dirs and queueing the files they contain
+// in pool according to rules. It returns an error if a rule's pattern is
+// malformed or a directory can't be read.
+func StartSpoolWatcher(pool *UploaderPool, dirs []string, rules []SpoolRule, opts ...SpoolOption) (*SpoolWatcher, error) {
+	for _, rule := range rules {
+		if _, err := filepath.Match(rule.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad spool pattern %q: %v", rule.Pattern, err)
+		}
+	}
+	for _, dir := range dirs {
+		if _, err := ioutil.ReadDir(dir); err != nil {
+			return nil, err
+		}
+	}
+	w := &SpoolWatcher{
+		pool:         pool,
+		dirs:         dirs,
+		rules:        rules,
+		pollInterval: DefaultSpoolPollInterval,
+		files:        make(map[string]*spoolFile),
+		stop:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	if !w.polling {
+		var err error
+		w.watcher, err = watchDirs(dirs)
+		if err != nil {
+			logger.WithError(err).Warn("Failed to watch spool directories, polling instead")
+		}
+	}
+	go w.run()
+	return w, nil
+}
+
+// Close stops watching. Files already queued are unaffected.
+func (w *SpoolWatcher) Close() {
+	w.once.Do(func() { close(w.stop) })
+	<-w.stopped
+}
+
+func (w *SpoolWatcher) run() {
+	defer close(w.stopped)
+	var events <-chan struct{}
+	if w.watcher != nil {
+		defer w.watcher.Close()
+		events = w.watcher.Events()
+	}
+	ticker := time.NewTicker(w.pollInterval)
+	defer ticker.Stop()
+	for {
+		if err := w.scan(); err == ErrPoolClosed {
+			return
+		}
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		case <-events:
+		}
+	}
+}
+
+// match returns the first rule matching name, or nil.
+func (w *SpoolWatcher) match(name string) *SpoolRule {
+	for i := range w.rules {
+		if ok, _ := filepath.Match(w.rules[i].Pattern, name); ok {
+			return &w.rules[i]
+		}
+	}
+	return nil
+}
+
+// scan queues every complete file which hasn't been queued yet. It returns
+// ErrPoolClosed if the pool has been closed. If the pool's queue stays full
+// for a poll interval, the remaining files are left for the next scan so
+// Close isn't held up.
+func (w *SpoolWatcher) scan() error {
+	now := time.Now()
+	full := false
+	seen := make(map[string]bool, len(w.files))
+	defer func() {
+		for path := range w.files {
+			if !seen[path] {
+				delete(w.files, path)
+			}
+		}
+	}()
+
+	for _, dir := range w.dirs {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			logger.WithError(err).WithField("dir", dir).Error("Failed to read spool directory")
+			// Don't forget the files in dir just because it couldn't be read.
+			for path := range w.files {
+				if filepath.Dir(path) == filepath.Clean(dir) {
+					seen[path] = true
+				}
+			}
+			continue
+		}
+		for _, info := range infos {
+			rule := w.match(info.Name())
+			if info.IsDir() || rule == nil {
+				continue
+			}
+			path := filepath.Join(dir, info.Name())
+			seen[path] = true
+
+			f := w.files[path]
+			if f != nil && f.submitted && os.SameFile(f.info, info) {
+				continue
+			}
+			if f == nil || f.submitted || f.info.Size() != info.Size() || !f.info.ModTime().Equal(info.ModTime()) {
+				f = &spoolFile{info: info, since: now}
+				w.files[path] = f
+			}
+			if full || now.Sub(info.ModTime()) < rule.MinAge || now.Sub(f.since) < rule.StableFor {
+				continue
+			}
+
+			err = w.pool.UploadWithTimeout(&UploadRequest{
+				Filename: path,
+				FileType: rule.FileType,
+				Lane:     rule.Lane,
+			}, w.pollInterval)
+			if err == ErrPoolClosed {
+				return err
+			} else if err == ErrQueueFull {
+				full = true
+				continue
+			} else if err != nil {
+				logger.WithError(err).WithField("filename", path).Error("Failed to queue spooled file")
+				continue
+			}
+			f.submitted = true
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+//go:build linux
+// +build linux
+
+package uploader
+
+import (
+	"os"
+	"syscall"
+)
+
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM |
+	syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_ATTRIB
+
+// inotifyWatcher watches directories with inotify.
+type inotifyWatcher struct {
+	file   *os.File
+	events chan struct{}
+}
+
+func watchDirs(dirs []string) (dirWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	for _, dir := range dirs {
+		if _, err = syscall.InotifyAddWatch(fd, dir, inotifyMask); err != nil {
+			syscall.Close(fd)
+			return nil, os.NewSyscallError("inotify_add_watch", err)
+		}
+	}
+	// A non-blocking fd is read through the runtime poller, so closing the
+	// file interrupts a pending read.
+	w := &inotifyWatcher{
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		events: make(chan struct{}, 1),
+	}
+	go w.read()
+	return w, nil
+}
+
+// read turns inotify events into wake ups. The scan works out what changed,
+// so the events themselves aren't decoded.
+func (w *inotifyWatcher) read() {
+	buf := make([]byte, 64*1024)
+	for {
+		if _, err := w.file.Read(buf); err != nil {
+			return
+		}
+		select {
+		case w.events <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (w *inotifyWatcher) Events() <-chan struct{} {
+	return w.events
+}
+
+func (w *inotifyWatcher) Close() error {
+	return w.file.Close()
+}
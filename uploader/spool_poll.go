@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package uploader
+
+import "errors"
+
+// watchDirs isn't supported here, so SpoolWatchers poll.
+func watchDirs(dirs []string) (dirWatcher, error) {
+	return nil, errors.New("watching directories is only supported on linux")
+}
@@ -0,0 +1,78 @@
+package uploader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSpoolWatcher(t *testing.T) {
+	for _, polling := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "spool_test")
+		if err != nil {
+			t.Fatalf("Error creating temp dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		write := func(name string) {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+				t.Fatalf("Error writing %s: %v", name, err)
+			}
+		}
+		write("a.gz")
+		write("b.txt")
+		write("skip.tmp")
+
+		notifier := &captureNotifier{}
+		pool := StartUploaderPool(1, &errorCaptureNotifier{}, notifier, &testUploadBuilder{})
+		opts := []SpoolOption{WithSpoolPollInterval(10 * time.Millisecond)}
+		if polling {
+			opts = append(opts, WithSpoolPolling())
+		}
+		watcher, err := StartSpoolWatcher(pool, []string{dir}, []SpoolRule{
+			{Pattern: "*.gz", FileType: Gzip},
+			{Pattern: "*.txt", FileType: Text, StableFor: 30 * time.Millisecond},
+		}, opts...)
+		if err != nil {
+			t.Fatalf("Error starting spool watcher: %v", err)
+		}
+
+		waitFor(t, "files present at startup", func() bool { return len(notifier.receipts()) == 2 })
+		write("c.gz")
+		waitFor(t, "new file", func() bool { return len(notifier.receipts()) == 3 })
+		// Give the watcher a chance to queue anything twice.
+		time.Sleep(50 * time.Millisecond)
+		watcher.Close()
+		pool.Close()
+
+		receipts := notifier.receipts()
+		sort.Strings(receipts)
+		expected := []string{filepath.Join(dir, "a.gz"), filepath.Join(dir, "b.txt"), filepath.Join(dir, "c.gz")}
+		if !reflect.DeepEqual(receipts, expected) {
+			t.Errorf("polling=%v: expected %v to be queued once each but got %v", polling, expected, receipts)
+		}
+	}
+}
+
+func TestSpoolWatcherRules(t *testing.T) {
+	if _, err := StartSpoolWatcher(nil, nil, []SpoolRule{{Pattern: "["}}); err == nil {
+		t.Error("expected an error for a malformed pattern")
+	}
+	if _, err := StartSpoolWatcher(nil, []string{"/does/not/exist"}, nil); err == nil {
+		t.Error("expected an error for a missing directory")
+	}
+
+	w := &SpoolWatcher{rules: []SpoolRule{
+		{Pattern: "*.gz", FileType: Gzip},
+		{Pattern: "*", FileType: Text},
+	}}
+	if rule := w.match("events.log.gz"); rule == nil || rule.FileType != Gzip {
+		t.Errorf("expected the gzip rule to match first but got %+v", rule)
+	}
+	if rule := w.match("events.log"); rule == nil || rule.FileType != Text {
+		t.Errorf("expected the catch all rule to match but got %+v", rule)
+	}
+}
@@ -0,0 +1,71 @@
+package uploader
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/twitchscience/aws_utils/monitoring"
+)
+
+// poolStats reports an UploaderPool's stats under a common prefix.
+type poolStats struct {
+	statter monitoring.SafeStatter
+	prefix  string
+}
+
+func newPoolStats(statter monitoring.SafeStatter, prefix string) *poolStats {
+	if prefix != "" {
+		prefix += "."
+	}
+	return &poolStats{statter: statter, prefix: prefix}
+}
+
+func (s *poolStats) queueDepth(depth int) {
+	s.statter.SafeGauge(s.prefix+"queue_depth", int64(depth), 1)
+}
+
+func (s *poolStats) laneQueueDepth(l *lane) {
+	s.statter.SafeGauge(s.prefix+"lane."+l.statName()+".queue_depth", atomic.LoadInt64(&l.depth), 1)
+}
+
+func (s *poolStats) highWater() {
+	s.statter.SafeInc(s.prefix+"queue_high_water", 1, 1)
+}
+
+func (s *poolStats) inFlight(n int64) {
+	s.statter.SafeGauge(s.prefix+"in_flight", n, 1)
+}
+
+func (s *poolStats) workers(n int) {
+	s.statter.SafeGauge(s.prefix+"workers", int64(n), 1)
+}
+
+func (s *poolStats) uploaded(receipt *UploadReceipt, latency time.Duration) {
+	if !receipt.Written {
+		s.statter.SafeInc(s.prefix+"skipped", 1, 1)
+		return
+	}
+	s.statter.SafeTimingDuration(s.prefix+"upload_latency", latency, 1)
+	s.statter.SafeInc(s.prefix+"uploads", 1, 1)
+	s.statter.SafeInc(s.prefix+"bytes_uploaded", receipt.Size, 1)
+	s.retries(receipt.Attempts)
+	if receipt.Throttled > 0 {
+		s.statter.SafeTimingDuration(s.prefix+"throttle_time", receipt.Throttled, 1)
+	}
+}
+
+func (s *poolStats) uploadFailure(attempts int) {
+	s.statter.SafeInc(s.prefix+"upload_failures", 1, 1)
+	s.retries(attempts)
+}
+
+// retries counts the attempts of an upload after the first.
+func (s *poolStats) retries(attempts int) {
+	if attempts > 1 {
+		s.statter.SafeInc(s.prefix+"retries", int64(attempts-1), 1)
+	}
+}
+
+func (s *poolStats) notifyFailure() {
+	s.statter.SafeInc(s.prefix+"notify_failures", 1, 1)
+}
@@ -0,0 +1,177 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/twitchscience/aws_utils/logger"
+)
+
+// DefaultMaxRequeues is how many times a RequeueErrorNotifier requeues each
+// request unless its MaxRequeues says otherwise.
+const DefaultMaxRequeues = 5
+
+// Stage is the part of handling a request which failed.
+type Stage string
+
+const (
+	// StageUpload means the file couldn't be uploaded.
+	StageUpload Stage = "upload"
+	// StageNotify means the file was uploaded, but the Notifier failed to
+	// send its receipt.
+	StageNotify Stage = "notify"
+)
+
+// UploadError is what an UploaderPool sends its ErrorNotifier when a request
+// fails. Its message is that of Err, so handlers which only log errors see
+// the same messages as before.
+type UploadError struct {
+	Request *UploadRequest
+	// Receipt is the receipt of the upload, for StageNotify errors.
+	Receipt *UploadReceipt
+	Stage   Stage
+	// Attempts is how many times the upload was tried, if known.
+	Attempts int
+	// Code is the AWS error code of Err, if it has one, e.g. AccessDenied.
+	Code string
+	Err  error
+}
+
+func newUploadError(stage Stage, req *UploadRequest, receipt *UploadReceipt, err error) *UploadError {
+	e := &UploadError{
+		Request: req,
+		Receipt: receipt,
+		Stage:   stage,
+		Code:    errorCode(err),
+		Err:     err,
+	}
+	var retryErr *RetryError
+	if receipt != nil {
+		e.Attempts = receipt.Attempts
+	} else if errors.As(err, &retryErr) {
+		e.Attempts = retryErr.Attempts
+	}
+	return e
+}
+
+func (e *UploadError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *UploadError) Unwrap() error {
+	return e.Err
+}
+
+// LogErrorNotifier is an ErrorNotifierHarness which logs each error with
+// logger, along with the details of *UploadErrors.
+type LogErrorNotifier struct{}
+
+// SendError logs err.
+func (LogErrorNotifier) SendError(err error) {
+	entry := logger.WithError(err)
+	var uploadErr *UploadError
+	if !errors.As(err, &uploadErr) {
+		entry.Error("Uploader pool error")
+		return
+	}
+	entry = entry.WithField("stage", uploadErr.Stage).WithField("attempts", uploadErr.Attempts)
+	if uploadErr.Request != nil {
+		entry = entry.WithField("filename", uploadErr.Request.Filename)
+	}
+	if uploadErr.Receipt != nil {
+		entry = entry.WithField("key", uploadErr.Receipt.KeyName)
+	}
+	if uploadErr.Code != "" {
+		entry = entry.WithField("code", uploadErr.Code)
+	}
+	entry.Error("Upload failed")
+}
+
+// RequeueErrorNotifier is an ErrorNotifierHarness which submits the requests
+// of failed uploads again after a delay. Use it with a Disposer which keeps
+// files whose upload failed, such as RemoveOnSuccess.
+//
+// Only uploads which ran out of attempts on a Retryable or Throttled error, or
+// which timed out, are requeued. Requests which failed any other way, e.g.
+// with a Permanent error, a missing file or invalid tags, whose receipt
+// couldn't be sent, which upload from a Reader, whose file is gone, or which
+// have been requeued MaxRequeues times already aren't requeued, and their
+// errors are passed to Next along with any other errors.
+type RequeueErrorNotifier struct {
+	// Requeue submits a request again, e.g. the pool's Upload method. Set it
+	// before submitting anything to the pool. It is called on its own
+	// goroutine, so it may block until there is room in the queue.
+	Requeue func(*UploadRequest) error
+	// Delay is how long to wait before requeueing a request.
+	Delay time.Duration
+	// MaxRequeues limits how many times each request is requeued. Zero
+	// means DefaultMaxRequeues, and a negative value means no limit.
+	MaxRequeues int
+	// Next, if set, is sent the errors which aren't requeued, including
+	// those of requests which Requeue fails to submit.
+	Next ErrorNotifierHarness
+}
+
+// SendError requeues the request of err after Delay, if it can be retried.
+func (n *RequeueErrorNotifier) SendError(err error) {
+	var uploadErr *UploadError
+	switch {
+	case n.Requeue == nil,
+		!errors.As(err, &uploadErr),
+		uploadErr.Stage != StageUpload,
+		uploadErr.Request == nil,
+		uploadErr.Request.Reader != nil,
+		!requeueable(uploadErr.Err),
+		n.exhausted(uploadErr.Request):
+		n.next(err)
+		return
+	}
+
+	req := uploadErr.Request
+	if req.isFile() {
+		if _, serr := os.Stat(req.Filename); serr != nil {
+			n.next(err)
+			return
+		}
+	}
+	req.requeues++
+	time.AfterFunc(n.Delay, func() {
+		if rerr := n.Requeue(req); rerr != nil {
+			logger.WithError(rerr).WithField("filename", req.Filename).Warn("Failed to requeue upload")
+			n.next(err)
+		}
+	})
+}
+
+// requeueable reports whether an upload which failed with err may succeed
+// later: it ran out of attempts on an error which isn't Permanent, or ran out
+// of time. Errors from before the upload started, like a missing file or
+// invalid metadata, will fail the same way again.
+func requeueable(err error) bool {
+	if errors.Is(err, os.ErrNotExist) {
+		return false
+	}
+	var retryErr *RetryError
+	if errors.As(err, &retryErr) {
+		return retryErr.Class == Retryable || retryErr.Class == Throttled
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// exhausted reports whether req has been requeued as many times as it may be.
+func (n *RequeueErrorNotifier) exhausted(req *UploadRequest) bool {
+	max := n.MaxRequeues
+	if max == 0 {
+		max = DefaultMaxRequeues
+	}
+	return max > 0 && req.requeues >= max
+}
+
+func (n *RequeueErrorNotifier) next(err error) {
+	if n.Next != nil {
+		n.Next.SendError(err)
+	}
+}
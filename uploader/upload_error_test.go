@@ -0,0 +1,134 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingErrorNotifier keeps the errors it is sent.
+type recordingErrorNotifier struct {
+	sync.Mutex
+	errs []error
+}
+
+func (r *recordingErrorNotifier) SendError(err error) {
+	r.Lock()
+	defer r.Unlock()
+	r.errs = append(r.errs, err)
+}
+
+func (r *recordingErrorNotifier) errors() []error {
+	r.Lock()
+	defer r.Unlock()
+	return append([]error(nil), r.errs...)
+}
+
+func TestUploaderPoolUploadErrors(t *testing.T) {
+	errorNotifier := &recordingErrorNotifier{}
+	testPool := StartUploaderPool(1, errorNotifier, &captureNotifier{}, &testUploadBuilder{})
+	uploadFailure := &UploadRequest{Filename: "uploaderror1"}
+	notifyFailure := &UploadRequest{Filename: "notifyerror2"}
+	testPool.Upload(uploadFailure)
+	testPool.Upload(notifyFailure)
+	testPool.Close()
+
+	errs := errorNotifier.errors()
+	if len(errs) != 2 {
+		t.Fatalf("Expected 2 errors, got %v", errs)
+	}
+	for _, err := range errs {
+		uploadErr, ok := err.(*UploadError)
+		if !ok {
+			t.Fatalf("Expected an UploadError, got %#v", err)
+		}
+		switch uploadErr.Request {
+		case uploadFailure:
+			if uploadErr.Stage != StageUpload || uploadErr.Receipt != nil || err.Error() != "uploaderror1" {
+				t.Errorf("Expected an upload stage error without a receipt, got %+v", uploadErr)
+			}
+		case notifyFailure:
+			if uploadErr.Stage != StageNotify || uploadErr.Receipt == nil || uploadErr.Attempts != 1 {
+				t.Errorf("Expected a notify stage error with a receipt, got %+v", uploadErr)
+			}
+		default:
+			t.Errorf("Expected the error to carry its request, got %+v", uploadErr)
+		}
+	}
+	LogErrorNotifier{}.SendError(errs[0])
+}
+
+func TestRequeueErrorNotifier(t *testing.T) {
+	next := &recordingErrorNotifier{}
+	requeued := make(chan *UploadRequest, 10)
+	n := &RequeueErrorNotifier{
+		Requeue: func(req *UploadRequest) error {
+			requeued <- req
+			return nil
+		},
+		Delay:       time.Millisecond,
+		MaxRequeues: 1,
+		Next:        next,
+	}
+
+	filename := writeTempFile(t, "retry")
+	defer os.Remove(filename)
+	req := &UploadRequest{Filename: filename}
+	failure := errors.New("failed")
+	retryable := &RetryError{Attempts: 3, Class: Retryable, Err: failure}
+	n.SendError(newUploadError(StageUpload, req, nil, retryable))
+	select {
+	case r := <-requeued:
+		if r != req {
+			t.Errorf("Expected %v to be requeued, got %v", req, r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the request to be requeued")
+	}
+
+	// These aren't requeued.
+	n.SendError(newUploadError(StageUpload, req, nil, retryable))
+	n.SendError(newUploadError(StageUpload, &UploadRequest{Filename: filename}, nil,
+		&RetryError{Attempts: 1, Class: Permanent, Err: failure}))
+	n.SendError(newUploadError(StageUpload, &UploadRequest{Filename: filename}, nil, failure))
+	n.SendError(newUploadError(StageUpload, &UploadRequest{Filename: filename}, nil, context.Canceled))
+	n.SendError(newUploadError(StageUpload, &UploadRequest{Filename: filename}, nil,
+		&ObjectExistsError{Bucket: "bucket", Key: "key"}))
+	_, notExist := os.Open(filename + ".missing")
+	n.SendError(newUploadError(StageUpload, &UploadRequest{Filename: filename + ".missing"}, nil, notExist))
+	n.SendError(newUploadError(StageUpload, &UploadRequest{Filename: filename + ".missing"}, nil, retryable))
+	n.SendError(newUploadError(StageNotify, &UploadRequest{Filename: filename}, &UploadReceipt{}, failure))
+	n.SendError(failure)
+	select {
+	case r := <-requeued:
+		t.Errorf("Expected nothing else to be requeued, got %v", r)
+	case <-time.After(10 * time.Millisecond):
+	}
+	if errs := next.errors(); len(errs) != 9 {
+		t.Errorf("Expected 9 errors passed on, got %v", errs)
+	}
+}
+
+func TestRequeueErrorNotifierDefaultLimit(t *testing.T) {
+	next := &recordingErrorNotifier{}
+	n := &RequeueErrorNotifier{
+		Requeue: func(*UploadRequest) error { return nil },
+		Next:    next,
+	}
+	filename := writeTempFile(t, "retry")
+	defer os.Remove(filename)
+	req := &UploadRequest{Filename: filename}
+	throttled := &RetryError{Attempts: 3, Class: Throttled, Err: errors.New("slow down")}
+	for i := 0; i <= DefaultMaxRequeues; i++ {
+		n.SendError(newUploadError(StageUpload, req, nil, throttled))
+	}
+	if req.requeues != DefaultMaxRequeues {
+		t.Errorf("Expected %d requeues, got %d", DefaultMaxRequeues, req.requeues)
+	}
+	if errs := next.errors(); len(errs) != 1 {
+		t.Errorf("Expected 1 error passed on, got %v", errs)
+	}
+}
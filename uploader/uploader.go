@@ -1,23 +1,33 @@
 /*
 Package uploader provides Uploader and UploaderPool, which move files to S3
-and fire a notification for each.
+and fire a notification for each, and Downloader and DownloaderPool, which
+fetch uploaded objects back to local files and verify them.
 */
 package uploader
 
 import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"io"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
-	"github.com/twitchscience/aws_utils/common"
+	"github.com/twitchscience/aws_utils/logger"
 )
 
 type FileTypeHeader string
 
 const (
 	Gzip FileTypeHeader = "application/x-gzip"
+	Zstd FileTypeHeader = "application/zstd"
 	Text FileTypeHeader = "text/plain"
+	JSON FileTypeHeader = "application/json"
 )
 
 // Factory is an interface to an object that makes new Uploader instances
@@ -30,24 +40,104 @@ type Uploader interface {
 	Upload(*UploadRequest) (*UploadReceipt, error)
 }
 
+// ContextUploader is an Uploader which can give up on an upload. The
+// uploaders made by this package's factories are ContextUploaders, and
+// UploaderPool uses UploadWithContext when its uploaders have it, so their
+// uploads can be timed out and canceled.
+type ContextUploader interface {
+	Uploader
+	// UploadWithContext is like Upload, but gives up once ctx is done. In
+	// that case the returned error is ctx.Err(), i.e. context.Canceled or
+	// context.DeadlineExceeded.
+	UploadWithContext(context.Context, *UploadRequest) (*UploadReceipt, error)
+}
+
+// uploadWithContext uploads req with u, giving up once ctx is done if u is a
+// ContextUploader.
+func uploadWithContext(ctx context.Context, u Uploader, req *UploadRequest) (*UploadReceipt, error) {
+	if cu, ok := u.(ContextUploader); ok {
+		return cu.UploadWithContext(ctx, req)
+	}
+	return u.Upload(req)
+}
+
 type factory struct {
 	bucket           string
 	keynameGenerator S3KeyNameGenerator
 	s3Uploader       s3manageriface.UploaderAPI
+	disposer         Disposer
+	checksums        ChecksumAlgorithm
+	objectOptions    ObjectOptions
+	compression      Compression
+	limiter          *BandwidthLimiter
+	skip             *skipIdentical
+	retry            RetryPolicy
+	multipart        *MultipartConfig
 }
 
 type uploader struct {
 	bucket           string
 	keynameGenerator S3KeyNameGenerator
 	s3Uploader       s3manageriface.UploaderAPI
+	disposer         Disposer
+	checksums        ChecksumAlgorithm
+	objectOptions    ObjectOptions
+	compression      Compression
+	limiter          *BandwidthLimiter
+	skip             *skipIdentical
+	retry            RetryPolicy
+	multipart        *MultipartConfig
 }
 
-func NewFactory(bucket string, keynameGenerator S3KeyNameGenerator, s3Uploader s3manageriface.UploaderAPI) Factory {
-	return &factory{
+// FactoryOption configures optional behavior of the Factory built by NewFactory.
+type FactoryOption func(*factory)
+
+// WithDisposer sets what happens to local files once their upload has
+// succeeded or failed. The default is RemoveAlways.
+func WithDisposer(d Disposer) FactoryOption {
+	return func(f *factory) {
+		f.disposer = d
+	}
+}
+
+// WithChecksums sets which checksums are computed for each file. The default
+// is ChecksumMD5. Checksums are stored in the object's metadata and reported
+// in the UploadReceipt.
+//
+// Unless the upload is compressed, the checksums have to be known before it
+// starts, so they are computed in a separate pass and each file is read
+// twice. They are sent with single-part uploads for S3 to validate, and an
+// MD5 is also checked against the ETag S3 returns. s3manager doesn't send
+// them with the parts of multipart uploads, whose ETags aren't MD5s either,
+// so multipart uploads aren't validated against them.
+func WithChecksums(algorithms ChecksumAlgorithm) FactoryOption {
+	return func(f *factory) {
+		f.checksums = algorithms
+	}
+}
+
+// WithBandwidthLimiter throttles the reads of every uploader made by the
+// Factory with l, so together they send at most l's limit.
+func WithBandwidthLimiter(l *BandwidthLimiter) FactoryOption {
+	return func(f *factory) {
+		f.limiter = l
+	}
+}
+
+func NewFactory(bucket string, keynameGenerator S3KeyNameGenerator, s3Uploader s3manageriface.UploaderAPI, opts ...FactoryOption) Factory {
+	f := &factory{
 		bucket:           bucket,
 		keynameGenerator: keynameGenerator,
 		s3Uploader:       s3Uploader,
+		disposer:         RemoveAlways,
+		checksums:        ChecksumMD5,
+		objectOptions:    defaultObjectOptions,
+		retry:            DefaultRetryPolicy,
+	}
+	for _, opt := range opts {
+		opt(f)
 	}
+	return f
 }
 
 func (f *factory) NewUploader() Uploader {
@@ -55,44 +145,212 @@ func (f *factory) NewUploader() Uploader {
 		bucket:           f.bucket,
 		keynameGenerator: f.keynameGenerator,
 		s3Uploader:       f.s3Uploader,
+		disposer:         f.disposer,
+		checksums:        f.checksums,
+		objectOptions:    f.objectOptions,
+		compression:      f.compression,
+		limiter:          f.limiter,
+		skip:             f.skip,
+		retry:            f.retry,
+		multipart:        f.multipart,
 	}
 }
 
-var retrier = &common.Retrier{
-	Times:         3,
-	BackoffFactor: 2,
+func (worker *uploader) Upload(req *UploadRequest) (*UploadReceipt, error) {
+	return worker.UploadWithContext(context.Background(), req)
 }
 
-func (worker *uploader) Upload(req *UploadRequest) (*UploadReceipt, error) {
-	file, err := os.Open(req.Filename)
+func (worker *uploader) UploadWithContext(ctx context.Context, req *UploadRequest) (*UploadReceipt, error) {
+	if req.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, req.Timeout)
+		defer cancel()
+	}
+
+	// Requests which can never be uploaded fail before the file is touched,
+	// so it isn't disposed of either.
+	if err := worker.validate(req); err != nil {
+		return nil, err
+	}
+	receipt, err := worker.upload(ctx, req)
+	if err == nil && req.uploaded != nil {
+		req.uploaded(receipt)
+	}
+	// There's nothing local to dispose of for in-memory requests.
+	if os.IsNotExist(err) || !req.isFile() {
+		return receipt, err
+	}
+	if derr := worker.disposer.Dispose(req, err); derr != nil {
+		logger.WithError(derr).WithField("filename", req.Filename).Error("Failed to dispose of uploaded file")
+	}
+	return receipt, err
+}
+
+// compressionFor returns the compression to upload req with.
+func (worker *uploader) compressionFor(req *UploadRequest) Compression {
+	if req.Compression != "" {
+		return req.Compression
+	}
+	return worker.compression
+}
+
+// validate checks req's compression, and its tags and metadata against S3's
+// limits, leaving room in the metadata for the checksums added during the
+// upload.
+func (worker *uploader) validate(req *UploadRequest) error {
+	compression := worker.compressionFor(req)
+	if err := compression.validate(); err != nil {
+		return err
+	}
+	if worker.skip != nil && compression.enabled() {
+		return fmt.Errorf("%s compressed uploads can't be skipped when identical", compression)
+	}
+	if err := validateTags(req.Tags); err != nil {
+		return err
+	}
+	metadata := requestMetadata(req)
+	if worker.checksums&ChecksumMD5 != 0 {
+		metadata[MD5MetadataKey] = strings.Repeat("0", 2*md5.Size)
+	}
+	if worker.checksums&ChecksumSHA256 != 0 {
+		metadata[SHA256MetadataKey] = strings.Repeat("0", 2*sha256.Size)
+	}
+	return validateMetadata(metadata)
+}
+
+// requestMetadata returns a copy of req's metadata with lowercased keys, with
+// room for the checksums.
+func requestMetadata(req *UploadRequest) map[string]string {
+	metadata := make(map[string]string, len(req.Metadata)+2)
+	for k, v := range req.Metadata {
+		metadata[strings.ToLower(k)] = v
+	}
+	return metadata
+}
+
+func (worker *uploader) upload(ctx context.Context, req *UploadRequest) (*UploadReceipt, error) {
+	file, size, err := req.open()
 	if err != nil {
 		return nil, err
 	}
-	// This means that if we fail to talk to s3 we still remove the file.
-	// I think that this is the correct behavior as we dont want to cause
-	// a HD overflow in case of a http timeout.
-	defer os.Remove(req.Filename)
-	keyName := worker.keynameGenerator.GetKeyName(req.Filename)
+	defer file.Close()
 
-	err = retrier.Retry(func() error {
-		// We need to seek to ensure that the retries read from the start of the file
-		file.Seek(0, 0)
+	retry := worker.retry.merge(req.Retry)
+	compression := worker.compressionFor(req)
+	keyName := getKeyName(worker.keynameGenerator, req.Filename+compression.extension(), req)
+	input := &s3manager.UploadInput{
+		Bucket:      aws.String(worker.bucket),
+		Key:         aws.String(keyName),
+		ContentType: aws.String(string(req.FileType)),
+	}
+	if compression.enabled() {
+		input.ContentType = aws.String(string(compression.fileType()))
+	}
+	objectOptions := worker.objectOptions.merge(req.ObjectOptions)
+	if objectOptions.ContentEncoding == "" {
+		objectOptions.ContentEncoding = compression.contentEncoding()
+	}
+	objectOptions.apply(input)
+	metadata := requestMetadata(req)
+	sums := newChecksummer(worker.checksums)
+	if !compression.enabled() {
+		// The checksums have to be known before the upload starts to be sent
+		// with it, so they are computed in a separate pass over the file.
+		if _, err = io.Copy(sums, file); err != nil {
+			return nil, err
+		}
+		if md5sum := sums.MD5(); md5sum != "" {
+			input.ContentMD5 = aws.String(hexToBase64(md5sum))
+			metadata[MD5MetadataKey] = md5sum
+		}
+		if sha256sum := sums.SHA256(); sha256sum != "" {
+			input.ChecksumSHA256 = aws.String(hexToBase64(sha256sum))
+			metadata[SHA256MetadataKey] = sha256sum
+		}
+	}
+	if len(metadata) > 0 {
+		input.Metadata = aws.StringMap(metadata)
+	} else {
+		metadata = nil
+	}
+	if len(req.Tags) > 0 {
+		input.Tagging = aws.String(encodeTags(req.Tags))
+	}
+	if worker.skip != nil {
+		head, err := worker.checkExisting(ctx, retry, input, sums, objectOptions)
+		if err != nil {
+			return nil, err
+		}
+		if head != nil {
+			return &UploadReceipt{
+				Path:        req.Filename,
+				KeyName:     worker.bucket + "/" + aws.StringValue(input.Key),
+				Size:        sums.size,
+				RawSize:     size,
+				MD5:         sums.MD5(),
+				SHA256:      sums.SHA256(),
+				ETag:        strings.Trim(aws.StringValue(head.ETag), `"`),
+				VersionID:   aws.StringValue(head.VersionId),
+				ContentType: FileTypeHeader(aws.StringValue(input.ContentType)),
+				UploadedAt:  aws.TimeValue(head.LastModified),
+				Metadata:    lowerKeys(aws.StringValueMap(head.Metadata)),
+				Tags:        req.Tags,
+			}, nil
+		}
+		keyName = aws.StringValue(input.Key)
+	}
 
-		_, e := worker.s3Uploader.Upload(&s3manager.UploadInput{
-			Bucket:      aws.String(worker.bucket),
-			Key:         aws.String(keyName),
-			ACL:         aws.String("bucket-owner-full-control"),
-			ContentType: aws.String(string(req.FileType)),
-			Body:        file,
-		})
+	var output *s3manager.UploadOutput
+	var throttled int64
+	uploadOptions := worker.multipart.options(size, compression.enabled())
+	attempts, err := retry.retry(ctx, func() error {
+		// We need to seek to ensure that the retries read from the start of the file
+		if _, e := file.Seek(0, io.SeekStart); e != nil {
+			return e
+		}
 
-		return e
+		var e error
+		var body io.Reader = file
+		if compression.enabled() {
+			sums = newChecksummer(worker.checksums)
+			compressed := compression.compress(file, sums)
+			defer compressed.Close()
+			body = compressed
+		}
+		input.Body = worker.limiter.limit(ctx, body, &throttled)
+		output, e = worker.s3Uploader.UploadWithContext(ctx, input, uploadOptions...)
+		if e != nil {
+			worker.multipart.abort(input, e)
+			return e
+		}
+		if etag := aws.StringValue(output.ETag); objectOptions.etagIsMD5() && !etagMatches(etag, sums.MD5()) {
+			return &ChecksumMismatchError{
+				Bucket: worker.bucket,
+				Key:    keyName,
+				MD5:    sums.MD5(),
+				ETag:   etag,
+			}
+		}
+		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
 	return &UploadReceipt{
-		Path:    req.Filename,
-		KeyName: worker.bucket + "/" + keyName,
+		Path:        req.Filename,
+		KeyName:     worker.bucket + "/" + keyName,
+		Size:        sums.size,
+		RawSize:     size,
+		MD5:         sums.MD5(),
+		SHA256:      sums.SHA256(),
+		ETag:        strings.Trim(aws.StringValue(output.ETag), `"`),
+		VersionID:   aws.StringValue(output.VersionID),
+		ContentType: FileTypeHeader(aws.StringValue(input.ContentType)),
+		UploadedAt:  time.Now(),
+		Attempts:    attempts,
+		Throttled:   time.Duration(throttled),
+		Written:     true,
+		Metadata:    metadata,
+		Tags:        req.Tags,
 	}, nil
 }
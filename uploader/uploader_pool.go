@@ -1,15 +1,20 @@
 package uploader
 
 import (
-	"log"
-	"os"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"sync"
-)
+	"sync/atomic"
+	"time"
 
-var (
-	debug = os.Getenv("debug")
+	"github.com/twitchscience/aws_utils/logger"
+	"github.com/twitchscience/aws_utils/monitoring"
 )
 
+// ErrorNotifierHarness is told about an UploaderPool's errors. Failed uploads
+// and notifications are sent as *UploadError.
 type ErrorNotifierHarness interface {
 	SendError(error)
 }
@@ -19,103 +24,671 @@ type NotifierHarness interface {
 }
 
 type UploadRequest struct {
+	// Filename is the file to upload. For in-memory requests it only names
+	// the object, through the key name generator, and in the receipt.
 	Filename string
+	// Data or Reader, if set, is uploaded instead of the file, e.g. with
+	// NewDataRequest or NewReaderRequest. Readers which can't seek are read
+	// into memory so the upload can be retried, and ReadSeekers are uploaded
+	// from their beginning. Nothing is disposed of after in-memory uploads,
+	// and they aren't recorded in a Journal since they can't be recovered.
+	// A request made by NewDataRequest uploads Data even if it is empty.
+	Data     []byte    `json:"-"`
+	Reader   io.Reader `json:"-"`
 	FileType FileTypeHeader
-	retry    int64
+	// source says where the request's contents come from, if a constructor
+	// said so, so that empty Data isn't mistaken for a file.
+	source bodySource
+	// Timeout bounds the time spent uploading this request, including
+	// retries. Zero means no limit beyond the submitting context.
+	Timeout time.Duration
+	// ObjectOptions, if set, overrides the Factory's object options for this
+	// request.
+	ObjectOptions *ObjectOptions
+	// Metadata is stored as S3 user metadata on the object, alongside any
+	// checksums. S3 lowercases the keys. See the Metadata* constants for
+	// well known keys.
+	Metadata map[string]string
+	// Tags are stored as S3 object tags, e.g. for lifecycle rules.
+	Tags map[string]string
+	// Compression, if set, overrides the Factory's compression for this
+	// request.
+	Compression Compression
+	// Lane is the name of the pool lane to queue the request in. See
+	// WithLane.
+	Lane string
+	// Retry, if set, overrides fields of the Factory's retry policy for
+	// this request.
+	Retry    *RetryPolicy
+	ctx      context.Context
+	requeues int
+	queuedAt time.Time
+	// seq identifies the request in the pool's Journal, if any.
+	seq uint64
+	// uploaded, if set, is called with the receipt of a successful upload
+	// before the file is disposed of, so the pool can journal the receipt
+	// while the file is still there to upload again.
+	uploaded func(*UploadReceipt)
+}
+
+// Context returns the context the request was submitted with, or
+// context.Background() if there is none.
+func (r *UploadRequest) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
 }
 
 type UploadReceipt struct {
 	Path    string
 	KeyName string
-	retry   int64
+	// Size is the number of bytes uploaded, and RawSize the size of the
+	// local file. They differ if the file was compressed while uploading.
+	Size    int64
+	RawSize int64
+	// MD5 and SHA256 are the hex checksums of the uploaded bytes, if the
+	// uploader was configured to compute them.
+	MD5    string
+	SHA256 string
+	// ETag and VersionID are as reported by S3. VersionID is only set for
+	// buckets with versioning enabled.
+	ETag      string
+	VersionID string
+	// ContentType is the object's Content-Type.
+	ContentType FileTypeHeader
+	// UploadedAt is when the upload finished, or for skipped uploads when
+	// the existing object was last modified.
+	UploadedAt time.Time
+	// Attempts is how many times the upload was tried.
+	Attempts int
+	// Throttled is how long the upload was held up by a BandwidthLimiter.
+	Throttled time.Duration
+	// Written is false if the upload was skipped because an identical
+	// object was already there. See WithSkipIdentical.
+	Written bool
+	// Metadata and Tags are as stored on the object. Metadata keys are
+	// lowercased, and include the checksum keys.
+	Metadata map[string]string
+	Tags     map[string]string
+	// Destinations lists the outcome for each destination of a fan-out
+	// upload. See NewFanOutFactory.
+	Destinations []DestinationReceipt
+	seq          uint64
+	// req is the request the receipt is for, when it came from a pool.
+	req *UploadRequest
+	// delivered journals the receipt as notified. A notifier which buffers
+	// receipts, like ManifestNotifier, takes it in SendMessage and calls it
+	// once the receipt is really sent on; otherwise the pool calls it when
+	// SendMessage succeeds.
+	delivered func()
 }
 
 type UploaderPool struct {
+	// Pool is the pool's workers. It changes as the pool is resized, so read
+	// it with Workers instead once the pool has started.
 	Pool          []Uploader
 	Notifier      NotifierHarness
 	ErrorNotifier ErrorNotifierHarness
 
 	finishedUploading chan bool
-	in                chan *UploadRequest
+	sched             *scheduler
 	out               chan *UploadReceipt
+	journal           *Journal
+	stats             *poolStats
+	inFlight          int64
+	bufferSize        int
+	laneWeights       map[string]int
+	starvationTimeout time.Duration
+
+	// builder makes new workers when the pool grows. workersMu guards Pool,
+	// workerIDs, which identifies the goroutine running each entry of Pool,
+	// and size, the number of workers the pool is being resized to. quit
+	// stops idle workers when the pool shrinks.
+	builder      Factory
+	workersMu    sync.Mutex
+	workerIDs    []int
+	nextWorkerID int
+	size         int
+	workers      sync.WaitGroup
+	quit         chan struct{}
+	scaler       *autoscaler
+
+	highWaterMark  int
+	onHighWater    func(depth int)
+	aboveHighWater int32
+
+	// mu guards closed; submitters hold a read lock so the scheduler can't
+	// be closed under them, and closing lets blocked submitters give up.
+	mu        sync.RWMutex
+	closed    bool
+	closing   chan struct{}
+	closeOnce sync.Once
+
+	// ctx is canceled when a CloseWithContext deadline passes, which aborts
+	// any upload still in progress.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// abandoned is closed when a Shutdown deadline passes. From then on
+	// queued requests and unsent receipts are set aside in leftovers
+	// instead of being uploaded and notified.
+	abandoned   chan struct{}
+	abandonOnce sync.Once
+	leftoverMu  sync.Mutex
+	leftovers   ShutdownReport
+}
+
+// ShutdownReport lists the work a pool had accepted but not finished when
+// its Shutdown deadline passed.
+type ShutdownReport struct {
+	// Requests were queued but never uploaded.
+	Requests []*UploadRequest
+	// Receipts are for files which were uploaded but not notified.
+	Receipts []*UploadReceipt
 }
 
 const UPLOAD_BUFFER_SIZE = 100
 
+var (
+	// ErrQueueFull is returned when a request can't be queued because the
+	// pool's buffer is full.
+	ErrQueueFull = errors.New("uploader pool queue is full")
+	// ErrPoolClosed is returned when a request is submitted to a pool which
+	// has been closed.
+	ErrPoolClosed = errors.New("uploader pool is closed")
+)
+
+// PoolOption configures optional behavior of an UploaderPool.
+type PoolOption func(*UploaderPool)
+
+// WithStatter reports the pool's stats to stats, with names starting with
+// prefix so that several pools can share a statter. The stats are
+//
+//	<prefix>.queue_depth      gauge of requests waiting for a worker
+//	<prefix>.lane.<name>.queue_depth
+//	                          gauge of requests waiting in each lane, where
+//	                          DefaultLane is named "default"
+//	<prefix>.queue_high_water count of times the queue reached its high-water mark
+//	<prefix>.in_flight        gauge of requests being uploaded
+//	<prefix>.workers          gauge of the number of workers
+//	<prefix>.upload_latency   timing of each successful upload
+//	<prefix>.uploads          count of successful uploads
+//	<prefix>.bytes_uploaded   count of bytes uploaded
+//	<prefix>.retries          count of upload attempts that were retried
+//	<prefix>.throttle_time    timing of how long each throttled upload was
+//	                          held up by a BandwidthLimiter
+//	<prefix>.skipped          count of uploads skipped as identical objects
+//	                          were already there
+//	<prefix>.upload_failures  count of requests that failed to upload
+//	<prefix>.notify_failures  count of receipts that failed to notify
+func WithStatter(stats monitoring.SafeStatter, prefix string) PoolOption {
+	return func(p *UploaderPool) {
+		p.stats = newPoolStats(stats, prefix)
+	}
+}
+
+// WithBufferSize sets how many requests can be queued in each lane waiting
+// for a worker. The default is UPLOAD_BUFFER_SIZE.
+func WithBufferSize(n int) PoolOption {
+	return func(p *UploaderPool) {
+		p.bufferSize = n
+	}
+}
+
+// WithHighWaterMark calls onHighWater, if it isn't nil, and increments the
+// <prefix>.queue_high_water stat whenever the queue depth reaches mark. It
+// isn't called again until the depth has dropped back below mark.
+// onHighWater is called on the submitting goroutine after the request has
+// been queued.
+func WithHighWaterMark(mark int, onHighWater func(depth int)) PoolOption {
+	return func(p *UploaderPool) {
+		p.highWaterMark = mark
+		p.onHighWater = onHighWater
+	}
+}
+
+// WithJournal records the pool's work in j, and resubmits whatever j holds
+// from a previous run when the pool starts. The caller should close j after
+// closing the pool.
+func WithJournal(j *Journal) PoolOption {
+	return func(p *UploaderPool) {
+		p.journal = j
+	}
+}
+
 func StartUploaderPool(
 	numWorkers int,
 	errorNotifier ErrorNotifierHarness,
 	notifier NotifierHarness,
 	builder Factory,
+	opts ...PoolOption,
 ) *UploaderPool {
-	workers := make([]Uploader, numWorkers)
-	in := make(chan *UploadRequest, UPLOAD_BUFFER_SIZE)
-	out := make(chan *UploadReceipt, UPLOAD_BUFFER_SIZE)
-	for i := 0; i < numWorkers; i++ {
-		workers[i] = builder.NewUploader()
-	}
+	ctx, cancel := context.WithCancel(context.Background())
 	pool := &UploaderPool{
-		Pool:              workers,
 		Notifier:          notifier,
 		ErrorNotifier:     errorNotifier,
-		in:                in,
-		out:               out,
 		finishedUploading: make(chan bool),
+		ctx:               ctx,
+		cancel:            cancel,
+		stats:             newPoolStats(monitoring.NewMockStatter(), ""),
+		bufferSize:        UPLOAD_BUFFER_SIZE,
+		laneWeights:       make(map[string]int),
+		starvationTimeout: DefaultStarvationTimeout,
+		closing:           make(chan struct{}),
+		builder:           builder,
+		size:              numWorkers,
+		quit:              make(chan struct{}),
+		abandoned:         make(chan struct{}),
 	}
+	for _, opt := range opts {
+		opt(pool)
+	}
+	pool.sched = newScheduler(pool.laneWeights, pool.bufferSize, pool.starvationTimeout)
+	pool.out = make(chan *UploadReceipt, pool.bufferSize)
+	pool.workersMu.Lock()
+	for i := 0; i < numWorkers; i++ {
+		pool.startWorker(builder.NewUploader())
+	}
+	pool.workersMu.Unlock()
+	pool.stats.workers(numWorkers)
 	go pool.Crank()
+	if pool.scaler != nil {
+		go pool.scaler.run(pool)
+	}
+	if pool.journal != nil {
+		requests, receipts := pool.journal.Pending()
+		for _, receipt := range receipts {
+			pool.out <- receipt
+		}
+		for _, req := range requests {
+			pool.queued(pool.sched.push(req))
+		}
+	}
 	return pool
 }
 
-func (p *UploaderPool) Upload(req *UploadRequest) {
-	p.in <- req
+// Upload queues req, blocking until there is room in the queue. It returns
+// ErrPoolClosed if the pool is closed.
+func (p *UploaderPool) Upload(req *UploadRequest) error {
+	return p.submit(context.Background(), req, nil)
+}
+
+// UploadWithContext queues req, blocking until there is room in the queue or
+// ctx is done. ctx also governs the upload itself: if it is canceled while
+// req is queued or uploading, the upload is abandoned and the error is sent
+// to the ErrorNotifier.
+func (p *UploaderPool) UploadWithContext(ctx context.Context, req *UploadRequest) error {
+	return p.submit(ctx, req, nil)
+}
+
+// TryUpload queues req if there is room in the queue, and returns
+// ErrQueueFull otherwise.
+func (p *UploaderPool) TryUpload(req *UploadRequest) error {
+	if l := p.sched.lane(req.Lane); len(l.queue) >= cap(l.queue) {
+		return ErrQueueFull
+	}
+	full := make(chan time.Time)
+	close(full)
+	return p.submit(context.Background(), req, full)
+}
+
+// UploadWithTimeout queues req, waiting up to timeout for room in the queue.
+// It returns ErrQueueFull if the queue stays full.
+func (p *UploaderPool) UploadWithTimeout(req *UploadRequest, timeout time.Duration) error {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	return p.submit(context.Background(), req, t.C)
+}
+
+// submit queues req, giving up with ErrQueueFull once full is ready, or with
+// ctx.Err() once ctx is done.
+func (p *UploaderPool) submit(ctx context.Context, req *UploadRequest, full <-chan time.Time) error {
+	l, err := p.enqueue(ctx, req, full)
+	if err == nil {
+		p.queued(l)
+	}
+	return err
+}
+
+func (p *UploaderPool) enqueue(ctx context.Context, req *UploadRequest, full <-chan time.Time) (*lane, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return nil, ErrPoolClosed
+	}
+
+	req.ctx = ctx
+	req.queuedAt = time.Now()
+	p.journalError(p.journal.accepted(req))
+	l := p.sched.lane(req.Lane)
+	// Prefer queueing over giving up if both are possible.
+	select {
+	case l.queue <- req:
+		p.sched.added(l)
+		return l, nil
+	default:
+	}
+
+	var err error
+	select {
+	case l.queue <- req:
+		p.sched.added(l)
+		return l, nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-full:
+		err = ErrQueueFull
+	case <-p.closing:
+		err = ErrPoolClosed
+	}
+	p.journalError(p.journal.failed(req))
+	return nil, err
+}
+
+// queued reports the queue depth after a request is queued in l.
+func (p *UploaderPool) queued(l *lane) {
+	depth := p.sched.queueDepth()
+	p.stats.queueDepth(depth)
+	p.stats.laneQueueDepth(l)
+	if p.highWaterMark > 0 && depth >= p.highWaterMark &&
+		atomic.CompareAndSwapInt32(&p.aboveHighWater, 0, 1) {
+		p.stats.highWater()
+		if p.onHighWater != nil {
+			p.onHighWater(depth)
+		}
+	}
+}
+
+// dequeued reports the queue depth after a request is taken off l.
+func (p *UploaderPool) dequeued(l *lane) {
+	depth := p.sched.queueDepth()
+	p.stats.queueDepth(depth)
+	p.stats.laneQueueDepth(l)
+	if depth < p.highWaterMark {
+		atomic.StoreInt32(&p.aboveHighWater, 0)
+	}
+}
+
+// journalError reports a failure to write to the journal. The pool carries on
+// regardless, it just can't recover the affected request after a crash.
+func (p *UploaderPool) journalError(err error) {
+	if err != nil {
+		p.ErrorNotifier.SendError(err)
+	}
+}
+
+// stopAccepting makes further submissions fail with ErrPoolClosed and closes
+// the queue.
+func (p *UploaderPool) stopAccepting() {
+	p.closeOnce.Do(func() {
+		close(p.closing)
+		p.mu.Lock()
+		p.closed = true
+		close(p.sched.ready)
+		p.mu.Unlock()
+	})
 }
 
 func (p *UploaderPool) Close() {
-	close(p.in)
+	p.stopAccepting()
 	<-p.finishedUploading
 }
 
-func (p *UploaderPool) Crank() {
-	w := &sync.WaitGroup{}
-	log.Println("DEBUG=" + debug)
-	for _, worker := range p.Pool {
-		w.Add(1)
+// CloseWithContext is like Close, but if ctx is done before everything queued
+// has been uploaded and notified, uploads in progress are canceled, the
+// remaining requests fail with context.Canceled, and ctx.Err() is returned
+// once the pool has drained.
+func (p *UploaderPool) CloseWithContext(ctx context.Context) error {
+	p.stopAccepting()
+	select {
+	case <-p.finishedUploading:
+		return nil
+	case <-ctx.Done():
+		p.cancel()
+		<-p.finishedUploading
+		return ctx.Err()
+	}
+}
+
+// Shutdown stops the pool accepting requests and waits for everything queued
+// to be uploaded and notified, like Close, until ctx is done. At that point
+// the uploads in progress are canceled, as by CloseWithContext, and nothing
+// else is uploaded or notified. Shutdown returns once the pool has stopped,
+// with ctx.Err() and a report of the requests and receipts that weren't
+// finished, including those of the canceled uploads, so they can be handled
+// elsewhere or resubmitted to a new pool. If the pool has a Journal, the
+// unfinished work also stays in it and is resubmitted by the next pool
+// started with the journal.
+func (p *UploaderPool) Shutdown(ctx context.Context) (*ShutdownReport, error) {
+	p.stopAccepting()
+	var err error
+	select {
+	case <-p.finishedUploading:
+	case <-ctx.Done():
+		p.abandonOnce.Do(func() { close(p.abandoned) })
+		p.cancel()
+		<-p.finishedUploading
+		err = ctx.Err()
+	}
+
+	p.leftoverMu.Lock()
+	defer p.leftoverMu.Unlock()
+	report := p.leftovers
+	return &report, err
+}
+
+// abandon sets aside request or receipt, whichever isn't nil, if a Shutdown
+// deadline has passed, and reports whether it did.
+func (p *UploaderPool) abandon(request *UploadRequest, receipt *UploadReceipt) bool {
+	select {
+	case <-p.abandoned:
+	default:
+		return false
+	}
+	p.leftoverMu.Lock()
+	defer p.leftoverMu.Unlock()
+	if request != nil {
+		p.leftovers.Requests = append(p.leftovers.Requests, request)
+	}
+	if receipt != nil {
+		p.leftovers.Receipts = append(p.leftovers.Receipts, receipt)
+	}
+	return true
+}
 
-		worker := worker
+// Resize grows or shrinks the pool to n workers, which must be at least 1.
+// New workers are made with the pool's Factory and start straight away.
+// Surplus workers stop once they finish the upload they are working on, so
+// nothing in flight is dropped, but the pool may briefly have more than n
+// workers.
+func (p *UploaderPool) Resize(n int) error {
+	if n < 1 {
+		return fmt.Errorf("uploader pool needs at least 1 worker, got %d", n)
+	}
+	// Hold off Close while resizing so it can't miss new workers.
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return ErrPoolClosed
+	}
 
+	p.workersMu.Lock()
+	defer p.workersMu.Unlock()
+	for ; p.size < n; p.size++ {
+		p.startWorker(p.builder.NewUploader())
+	}
+	if surplus := p.size - n; surplus > 0 {
+		p.size = n
 		go func() {
-			// Close() should cause the loggers to close thier channels
-			for request := range p.in {
-				if debug != "" {
-					log.Println(request)
-				}
-				reciept, err := worker.Upload(request)
-				if err != nil {
-					p.ErrorNotifier.SendError(err)
-				} else {
-					p.out <- reciept
+			for i := 0; i < surplus; i++ {
+				select {
+				case p.quit <- struct{}{}:
+				case <-p.closing:
+					return
 				}
 			}
-
-			// which will then decrement the job counter
-			w.Done()
 		}()
 	}
+	p.stats.workers(n)
+	return nil
+}
+
+// Size returns the number of workers the pool has, or is being resized to.
+func (p *UploaderPool) Size() int {
+	p.workersMu.Lock()
+	defer p.workersMu.Unlock()
+	return p.size
+}
+
+// Workers returns the pool's running workers.
+func (p *UploaderPool) Workers() []Uploader {
+	p.workersMu.Lock()
+	defer p.workersMu.Unlock()
+	return append([]Uploader(nil), p.Pool...)
+}
+
+// startWorker adds worker to the pool and starts it. The caller must hold
+// workersMu.
+func (p *UploaderPool) startWorker(worker Uploader) {
+	p.nextWorkerID++
+	id := p.nextWorkerID
+	p.Pool = append(p.Pool, worker)
+	p.workerIDs = append(p.workerIDs, id)
+	p.workers.Add(1)
+	go p.work(id, worker)
+}
+
+// work uploads queued requests with worker until the pool is closed and
+// drained, or the worker is told to quit.
+func (p *UploaderPool) work(id int, worker Uploader) {
+	defer p.workers.Done()
+	// Close() should cause the loggers to close thier channels
+	for {
+		request, l, ok := p.sched.next(p.quit)
+		if !ok {
+			break
+		}
+		p.dequeued(l)
+		if p.abandon(request, nil) {
+			continue
+		}
+		logger.WithField("filename", request.Filename).Debug("Uploading")
+		p.process(worker, request)
+	}
+
+	p.workersMu.Lock()
+	defer p.workersMu.Unlock()
+	for i, wid := range p.workerIDs {
+		if wid == id {
+			p.Pool = append(p.Pool[:i:i], p.Pool[i+1:]...)
+			p.workerIDs = append(p.workerIDs[:i:i], p.workerIDs[i+1:]...)
+			break
+		}
+	}
+}
+
+func (p *UploaderPool) inFlightCount() int64 {
+	return atomic.LoadInt64(&p.inFlight)
+}
+
+// requestContext returns a context for uploading req which is done when
+// either the request's own context or the pool's context is.
+func (p *UploaderPool) requestContext(req *UploadRequest) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(req.Context())
+	if p.ctx.Err() != nil {
+		cancel()
+		return ctx, cancel
+	}
+	go func() {
+		select {
+		case <-p.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// process uploads request with worker and queues its receipt for
+// notification.
+func (p *UploaderPool) process(worker Uploader, request *UploadRequest) {
+	inFlight := atomic.AddInt64(&p.inFlight, 1)
+	p.stats.inFlight(inFlight)
+	p.scaler.started(inFlight)
+	defer func() {
+		p.stats.inFlight(atomic.AddInt64(&p.inFlight, -1))
+	}()
+
+	ctx, cancel := p.requestContext(request)
+	defer cancel()
+	journaled := false
+	request.uploaded = func(r *UploadReceipt) {
+		r.seq = request.seq
+		p.journalError(p.journal.uploaded(r))
+		journaled = true
+	}
+	var reciept *UploadReceipt
+	// Don't bother starting uploads which were abandoned while queued.
+	err := ctx.Err()
+	if err == nil {
+		start := time.Now()
+		reciept, err = uploadWithContext(ctx, worker, request)
+		if err == nil {
+			latency := time.Since(start)
+			p.stats.uploaded(reciept, latency)
+			p.scaler.finished(latency)
+		}
+	}
+	// Uploads canceled by a Shutdown deadline haven't failed, they're just
+	// unfinished.
+	if err != nil && p.ctx.Err() != nil && errors.Is(err, context.Canceled) && p.abandon(request, nil) {
+		return
+	}
+	if err != nil {
+		uploadErr := newUploadError(StageUpload, request, nil, err)
+		p.stats.uploadFailure(uploadErr.Attempts)
+		p.ErrorNotifier.SendError(uploadErr)
+		p.journalError(p.journal.failed(request))
+		return
+	}
+	reciept.seq = request.seq
+	reciept.req = request
+	// Uploaders which don't call request.uploaded have disposed of the file
+	// already, so the receipt is journaled as soon as possible.
+	if !journaled {
+		p.journalError(p.journal.uploaded(reciept))
+	}
+	p.out <- reciept
+}
+
+func (p *UploaderPool) Crank() {
 	go func() {
 		for reciept := range p.out {
-			if debug != "" {
-				log.Println(reciept)
+			if p.abandon(nil, reciept) {
+				continue
+			}
+			logger.WithField("key", reciept.KeyName).Debug("Sending receipt")
+			r := reciept
+			reciept.delivered = func() {
+				p.journalError(p.journal.notified(r))
 			}
 			err := p.Notifier.SendMessage(reciept)
+			delivered := reciept.delivered
+			reciept.delivered = nil
 			if err != nil {
-				p.ErrorNotifier.SendError(err)
+				p.stats.notifyFailure()
+				p.ErrorNotifier.SendError(newUploadError(StageNotify, reciept.req, reciept, err))
+			} else if delivered != nil {
+				delivered()
 			}
 		}
 		// once the uploaders are drained tell the outside world
-		p.finishedUploading <- true
+		close(p.finishedUploading)
 	}()
 	// when the jobs are finished then close the notify channel
 	// this should cause the drain of the uploaders to be cleaned up appropriately.
-	w.Wait()
+	p.workers.Wait()
 	close(p.out)
+	p.cancel()
 }
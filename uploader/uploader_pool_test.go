@@ -1,18 +1,23 @@
 package uploader
 
 import (
+	"context"
 	"errors"
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type errorCaptureNotifier struct {
+	sync.Mutex
 	Errors []string
 }
 
 type captureNotifier struct {
+	sync.Mutex
 	receipt []string
 }
 
@@ -22,7 +27,44 @@ type testUploader struct {
 
 type testUploadBuilder struct{}
 
+// captureStatter records the sum of each counter and the last value of each
+// gauge.
+type captureStatter struct {
+	sync.Mutex
+	counters map[string]int64
+	gauges   map[string]int64
+	timings  map[string]int
+}
+
+func newCaptureStatter() *captureStatter {
+	return &captureStatter{
+		counters: make(map[string]int64),
+		gauges:   make(map[string]int64),
+		timings:  make(map[string]int),
+	}
+}
+
+func (c *captureStatter) SafeInc(stat string, value int64, rate float32) {
+	c.Lock()
+	defer c.Unlock()
+	c.counters[stat] += value
+}
+
+func (c *captureStatter) SafeGauge(stat string, value int64, rate float32) {
+	c.Lock()
+	defer c.Unlock()
+	c.gauges[stat] = value
+}
+
+func (c *captureStatter) SafeTimingDuration(stat string, delta time.Duration, rate float32) {
+	c.Lock()
+	defer c.Unlock()
+	c.timings[stat]++
+}
+
 func (e *errorCaptureNotifier) SendError(err error) {
+	e.Lock()
+	defer e.Unlock()
 	e.Errors = append(e.Errors, err.Error())
 }
 
@@ -30,6 +72,8 @@ func (c *captureNotifier) SendMessage(r *UploadReceipt) error {
 	if strings.Contains(r.Path, "notifyerror") {
 		return errors.New(r.Path)
 	}
+	c.Lock()
+	defer c.Unlock()
 	c.receipt = append(c.receipt, r.Path)
 	return nil
 }
@@ -43,21 +87,68 @@ func (t *testUploader) TargetLocation() string {
 }
 
 func (t *testUploader) Upload(req *UploadRequest) (*UploadReceipt, error) {
+	return t.UploadWithContext(context.Background(), req)
+}
+
+func (t *testUploader) UploadWithContext(ctx context.Context, req *UploadRequest) (*UploadReceipt, error) {
+	if strings.Contains(req.Filename, "block") {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if strings.Contains(req.Filename, "slow") {
+		time.Sleep(50 * time.Millisecond)
+	}
 	if strings.Contains(req.Filename, "uploaderror") {
+		if retries := strings.Count(req.Filename, "retry"); retries > 0 {
+			return nil, &RetryError{Attempts: 1 + retries, Err: errors.New(req.Filename)}
+		}
 		return nil, errors.New(req.Filename)
 	}
 
 	t.req = append(t.req, req)
 	return &UploadReceipt{
-		Path:    req.Filename,
-		KeyName: t.GetKeyName(req.Filename),
+		Path:     req.Filename,
+		KeyName:  t.GetKeyName(req.Filename),
+		Size:     int64(len(req.Filename)),
+		Attempts: 1 + strings.Count(req.Filename, "retry"),
+		Written:  !strings.Contains(req.Filename, "skip"),
 	}, nil
 }
 
-func (t *testUploadBuilder) BuildUploader() Uploader {
+func (t *testUploadBuilder) NewUploader() Uploader {
 	return &testUploader{}
 }
 
+// receipts returns a copy of the paths notified so far.
+func (c *captureNotifier) receipts() []string {
+	c.Lock()
+	defer c.Unlock()
+	return append([]string(nil), c.receipt...)
+}
+
+// plainUploader is an Uploader without UploadWithContext, like those written
+// before it was added.
+type plainUploader struct{}
+
+func (plainUploader) Upload(req *UploadRequest) (*UploadReceipt, error) {
+	return &UploadReceipt{Path: req.Filename, KeyName: req.Filename, Written: true}, nil
+}
+
+type plainUploadBuilder struct{}
+
+func (plainUploadBuilder) NewUploader() Uploader {
+	return plainUploader{}
+}
+
+func TestUploaderPoolPlainUploader(t *testing.T) {
+	testPool := StartUploaderPool(1, &errorCaptureNotifier{}, &captureNotifier{}, plainUploadBuilder{})
+	testPool.Upload(&UploadRequest{Filename: "test1", FileType: Gzip})
+	testPool.Close()
+	if notified := testPool.Notifier.(*captureNotifier).receipt; !reflect.DeepEqual(notified, []string{"test1"}) {
+		t.Errorf("expected test1 to be notified but got %v", notified)
+	}
+}
+
 func TestUploaderPool(t *testing.T) {
 	testPool := StartUploaderPool(
 		2,
@@ -133,3 +224,318 @@ func TestUploaderPool(t *testing.T) {
 		)
 	}
 }
+
+func TestUploaderPoolCloseWithContext(t *testing.T) {
+	testPool := StartUploaderPool(
+		1,
+		&errorCaptureNotifier{},
+		&captureNotifier{},
+		&testUploadBuilder{},
+	)
+	testPool.Upload(&UploadRequest{Filename: "block1", FileType: Gzip})
+	testPool.Upload(&UploadRequest{Filename: "test1", FileType: Gzip})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := testPool.CloseWithContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected %v but got %v", context.DeadlineExceeded, err)
+	}
+
+	// test1 is queued behind the stuck upload, so it is abandoned as well.
+	expectedErrors := []string{
+		context.Canceled.Error(),
+		context.Canceled.Error(),
+	}
+	if !reflect.DeepEqual(
+		testPool.ErrorNotifier.(*errorCaptureNotifier).Errors,
+		expectedErrors,
+	) {
+		t.Errorf("expected %s but got %s\n", expectedErrors,
+			testPool.ErrorNotifier.(*errorCaptureNotifier).Errors,
+		)
+	}
+}
+
+func TestUploaderPoolRequestContext(t *testing.T) {
+	testPool := StartUploaderPool(
+		1,
+		&errorCaptureNotifier{},
+		&captureNotifier{},
+		&testUploadBuilder{},
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := testPool.UploadWithContext(ctx, &UploadRequest{Filename: "block1", FileType: Gzip})
+	if err != nil {
+		t.Fatalf("expected to queue request, got %v", err)
+	}
+	testPool.Close()
+
+	expectedErrors := []string{context.DeadlineExceeded.Error()}
+	if !reflect.DeepEqual(
+		testPool.ErrorNotifier.(*errorCaptureNotifier).Errors,
+		expectedErrors,
+	) {
+		t.Errorf("expected %s but got %s\n", expectedErrors,
+			testPool.ErrorNotifier.(*errorCaptureNotifier).Errors,
+		)
+	}
+}
+
+func TestUploaderPoolStats(t *testing.T) {
+	stats := newCaptureStatter()
+	testPool := StartUploaderPool(
+		2,
+		&errorCaptureNotifier{},
+		&captureNotifier{},
+		&testUploadBuilder{},
+		WithStatter(stats, "pool"),
+	)
+	for _, fn := range []string{"test1", "retryretry2", "retryuploaderror3", "notifyerror4", "skip5"} {
+		testPool.Upload(&UploadRequest{Filename: fn, FileType: Gzip})
+	}
+	testPool.Close()
+
+	expectedCounters := map[string]int64{
+		"pool.uploads":         3,
+		"pool.bytes_uploaded":  int64(len("test1retryretry2notifyerror4")),
+		"pool.retries":         3,
+		"pool.upload_failures": 1,
+		"pool.notify_failures": 1,
+		"pool.skipped":         1,
+	}
+	if !reflect.DeepEqual(stats.counters, expectedCounters) {
+		t.Errorf("expected counters %v but got %v", expectedCounters, stats.counters)
+	}
+	// Gauges are reported concurrently, so only check they were reported.
+	for _, gauge := range []string{"pool.queue_depth", "pool.lane.default.queue_depth", "pool.in_flight"} {
+		if _, ok := stats.gauges[gauge]; !ok {
+			t.Errorf("expected gauge %s to be reported", gauge)
+		}
+	}
+	if stats.timings["pool.upload_latency"] != 3 {
+		t.Errorf("expected 3 upload latencies but got %d", stats.timings["pool.upload_latency"])
+	}
+}
+
+func TestUploaderPoolBackpressure(t *testing.T) {
+	var highWater []int
+	testPool := StartUploaderPool(
+		1,
+		&errorCaptureNotifier{},
+		&captureNotifier{},
+		&testUploadBuilder{},
+		WithBufferSize(2),
+		WithHighWaterMark(2, func(depth int) { highWater = append(highWater, depth) }),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	// Occupy the only worker, then fill the queue.
+	if err := testPool.UploadWithContext(ctx, &UploadRequest{Filename: "block1"}); err != nil {
+		t.Fatalf("expected to queue block1, got %v", err)
+	}
+	for testPool.inFlightCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for _, fn := range []string{"test1", "test2"} {
+		if err := testPool.TryUpload(&UploadRequest{Filename: fn}); err != nil {
+			t.Fatalf("expected to queue %s, got %v", fn, err)
+		}
+	}
+	if err := testPool.TryUpload(&UploadRequest{Filename: "test3"}); err != ErrQueueFull {
+		t.Errorf("expected %v but got %v", ErrQueueFull, err)
+	}
+	if err := testPool.UploadWithTimeout(&UploadRequest{Filename: "test3"}, 10*time.Millisecond); err != ErrQueueFull {
+		t.Errorf("expected %v but got %v", ErrQueueFull, err)
+	}
+	if !reflect.DeepEqual(highWater, []int{2}) {
+		t.Errorf("expected one high-water callback at depth 2, got %v", highWater)
+	}
+
+	cancel()
+	testPool.Close()
+	if err := testPool.Upload(&UploadRequest{Filename: "test4"}); err != ErrPoolClosed {
+		t.Errorf("expected %v but got %v", ErrPoolClosed, err)
+	}
+	if err := testPool.TryUpload(&UploadRequest{Filename: "test4"}); err != ErrPoolClosed {
+		t.Errorf("expected %v but got %v", ErrPoolClosed, err)
+	}
+	testPool.Close()
+
+	expectedNotifies := []string{"test1", "test2"}
+	sort.Strings(testPool.Notifier.(*captureNotifier).receipt)
+	if !reflect.DeepEqual(testPool.Notifier.(*captureNotifier).receipt, expectedNotifies) {
+		t.Errorf("expected %s got %s\n", expectedNotifies,
+			testPool.Notifier.(*captureNotifier).receipt,
+		)
+	}
+}
+
+// waitFor polls cond until it is true, failing the test if it takes more
+// than a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestUploaderPoolResize(t *testing.T) {
+	stats := newCaptureStatter()
+	testPool := StartUploaderPool(
+		1,
+		&errorCaptureNotifier{},
+		&captureNotifier{},
+		&testUploadBuilder{},
+		WithStatter(stats, "pool"),
+	)
+	if err := testPool.Resize(3); err != nil {
+		t.Fatalf("expected to resize, got %v", err)
+	}
+	if size, workers := testPool.Size(), len(testPool.Workers()); size != 3 || workers != 3 {
+		t.Errorf("expected 3 workers but got size %d with %d workers", size, workers)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	for _, fn := range []string{"block1", "block2", "block3"} {
+		if err := testPool.UploadWithContext(ctx, &UploadRequest{Filename: fn, FileType: Gzip}); err != nil {
+			t.Fatalf("expected to queue %s, got %v", fn, err)
+		}
+	}
+	waitFor(t, "uploads to start", func() bool { return testPool.inFlightCount() == 3 })
+
+	if err := testPool.Resize(1); err != nil {
+		t.Fatalf("expected to resize, got %v", err)
+	}
+	// Workers in the middle of an upload carry on until it's done.
+	if size, workers := testPool.Size(), len(testPool.Workers()); size != 1 || workers != 3 {
+		t.Errorf("expected size 1 with 3 workers but got size %d with %d workers", size, workers)
+	}
+	cancel()
+	waitFor(t, "surplus workers to stop", func() bool { return len(testPool.Workers()) == 1 })
+
+	if err := testPool.Upload(&UploadRequest{Filename: "test1", FileType: Gzip}); err != nil {
+		t.Fatalf("expected to queue test1, got %v", err)
+	}
+	testPool.Close()
+
+	if receipts := testPool.Notifier.(*captureNotifier).receipt; !reflect.DeepEqual(receipts, []string{"test1"}) {
+		t.Errorf("expected a receipt for test1 but got %v", receipts)
+	}
+	if errs := testPool.ErrorNotifier.(*errorCaptureNotifier).Errors; len(errs) != 3 {
+		t.Errorf("expected the 3 blocked uploads to fail but got %v", errs)
+	}
+	if stats.gauges["pool.workers"] != 1 {
+		t.Errorf("expected workers gauge of 1 but got %d", stats.gauges["pool.workers"])
+	}
+	if err := testPool.Resize(2); err != ErrPoolClosed {
+		t.Errorf("expected %v resizing a closed pool but got %v", ErrPoolClosed, err)
+	}
+	if err := testPool.Resize(0); err == nil {
+		t.Error("expected an error resizing to 0 workers")
+	}
+}
+
+func TestUploaderPoolShutdown(t *testing.T) {
+	testPool := StartUploaderPool(
+		1,
+		&errorCaptureNotifier{},
+		&captureNotifier{},
+		&testUploadBuilder{},
+	)
+	for _, fn := range []string{"slow1", "test2", "test3"} {
+		if err := testPool.Upload(&UploadRequest{Filename: fn, FileType: Gzip}); err != nil {
+			t.Fatalf("expected to queue %s, got %v", fn, err)
+		}
+	}
+	waitFor(t, "upload to start", func() bool { return testPool.inFlightCount() == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	report, err := testPool.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected %v but got %v", context.DeadlineExceeded, err)
+	}
+
+	var requests, receipts []string
+	for _, req := range report.Requests {
+		requests = append(requests, req.Filename)
+	}
+	for _, receipt := range report.Receipts {
+		receipts = append(receipts, receipt.Path)
+	}
+	// The upload in progress finishes, but isn't notified.
+	if !reflect.DeepEqual(requests, []string{"test2", "test3"}) {
+		t.Errorf("expected leftover requests test2 and test3 but got %v", requests)
+	}
+	if !reflect.DeepEqual(receipts, []string{"slow1"}) {
+		t.Errorf("expected leftover receipt slow1 but got %v", receipts)
+	}
+	if notified := testPool.Notifier.(*captureNotifier).receipt; len(notified) != 0 {
+		t.Errorf("expected nothing to be notified but got %v", notified)
+	}
+	if errs := testPool.ErrorNotifier.(*errorCaptureNotifier).Errors; len(errs) != 0 {
+		t.Errorf("expected no errors but got %v", errs)
+	}
+	if err = testPool.Upload(&UploadRequest{Filename: "test4"}); err != ErrPoolClosed {
+		t.Errorf("expected %v after shutdown but got %v", ErrPoolClosed, err)
+	}
+}
+
+func TestUploaderPoolShutdownCancelsUploads(t *testing.T) {
+	testPool := StartUploaderPool(
+		1,
+		&errorCaptureNotifier{},
+		&captureNotifier{},
+		&testUploadBuilder{},
+	)
+	for _, fn := range []string{"block1", "test2"} {
+		if err := testPool.Upload(&UploadRequest{Filename: fn, FileType: Gzip}); err != nil {
+			t.Fatalf("expected to queue %s, got %v", fn, err)
+		}
+	}
+	waitFor(t, "upload to start", func() bool { return testPool.inFlightCount() == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	report, err := testPool.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected %v but got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected Shutdown to return soon after its deadline but took %v", elapsed)
+	}
+
+	// The blocked upload is canceled and reported rather than failed.
+	var requests []string
+	for _, req := range report.Requests {
+		requests = append(requests, req.Filename)
+	}
+	if !reflect.DeepEqual(requests, []string{"block1", "test2"}) {
+		t.Errorf("expected leftover requests block1 and test2 but got %v", requests)
+	}
+	if errs := testPool.ErrorNotifier.(*errorCaptureNotifier).Errors; len(errs) != 0 {
+		t.Errorf("expected no errors but got %v", errs)
+	}
+}
+
+func TestUploaderPoolShutdownInTime(t *testing.T) {
+	testPool := StartUploaderPool(
+		1,
+		&errorCaptureNotifier{},
+		&captureNotifier{},
+		&testUploadBuilder{},
+	)
+	testPool.Upload(&UploadRequest{Filename: "test1", FileType: Gzip})
+	report, err := testPool.Shutdown(context.Background())
+	if err != nil || len(report.Requests) != 0 || len(report.Receipts) != 0 {
+		t.Errorf("expected a clean shutdown but got %+v and %v", report, err)
+	}
+	if notified := testPool.Notifier.(*captureNotifier).receipt; !reflect.DeepEqual(notified, []string{"test1"}) {
+		t.Errorf("expected test1 to be notified but got %v", notified)
+	}
+}
@@ -1,17 +1,31 @@
 package uploader
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
+	"github.com/klauspost/compress/zstd"
 	"github.com/twinj/uuid"
+	"github.com/twitchscience/aws_utils/mocks"
 )
 
 const (
@@ -34,6 +48,64 @@ type simpleNameGenerator struct {
 
 func (s *simpleNameGenerator) GetKeyName(in string) string { return s.prefix + "/" + in }
 
+// blockingS3Uploader never finishes an upload until its context is done.
+type blockingS3Uploader struct {
+	s3manageriface.UploaderAPI
+}
+
+func (b *blockingS3Uploader) UploadWithContext(ctx aws.Context, in *s3manager.UploadInput, opts ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// recordingS3Uploader reads and records each upload, replying with the MD5 of
+// the body as the ETag unless etag is set.
+type recordingS3Uploader struct {
+	s3manageriface.UploaderAPI
+
+	etag   string
+	inputs []*s3manager.UploadInput
+	bodies [][]byte
+}
+
+func (r *recordingS3Uploader) UploadWithContext(ctx aws.Context, in *s3manager.UploadInput, opts ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	body, err := ioutil.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.inputs = append(r.inputs, in)
+	r.bodies = append(r.bodies, body)
+	etag := r.etag
+	if etag == "" {
+		sum := md5.Sum(body)
+		etag = hex.EncodeToString(sum[:])
+	}
+	return &s3manager.UploadOutput{
+		ETag:      aws.String(`"` + etag + `"`),
+		VersionID: aws.String("v1"),
+	}, nil
+}
+
+// noBackoff disables sleeping between retries for the duration of a test.
+func noBackoff() func() {
+	saved := DefaultRetryPolicy
+	DefaultRetryPolicy.Backoff = time.Nanosecond
+	DefaultRetryPolicy.ThrottleBackoff = time.Nanosecond
+	return func() { DefaultRetryPolicy = saved }
+}
+
+func writeTempFile(t *testing.T, contents string) string {
+	f, err := ioutil.TempFile("", "uploader_test")
+	if err != nil {
+		t.Fatalf("Error creating temp file: %v", err)
+	}
+	defer f.Close()
+	if _, err = f.WriteString(contents); err != nil {
+		t.Fatalf("Error writing temp file: %v", err)
+	}
+	return f.Name()
+}
+
 // Generate some files of increasing size
 func createTempFiles(tempfolder string) error {
 	for i := 0; i < testFiles; i++ {
@@ -105,7 +177,7 @@ func TestUploader(t *testing.T) {
 			_, err = u.Upload(&UploadRequest{
 				Filename: fn,
 				FileType: Text,
-				retry:    2,
+				Retry:    &RetryPolicy{MaxAttempts: 2},
 			})
 			if err != nil {
 				t.Errorf("Failed to upload %s: %v", fn, err)
@@ -128,3 +200,428 @@ func TestUploader(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestUploaderTimeout(t *testing.T) {
+	f, err := ioutil.TempFile("", "uploader_test")
+	if err != nil {
+		t.Fatalf("Error creating temp file: %v", err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	u := NewFactory("bucket", &simpleNameGenerator{prefix: "test"}, &blockingS3Uploader{},
+		WithDisposer(RemoveOnSuccess)).NewUploader()
+	start := time.Now()
+	_, err = u.(ContextUploader).UploadWithContext(context.Background(), &UploadRequest{
+		Filename: f.Name(),
+		FileType: Text,
+		Timeout:  50 * time.Millisecond,
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected upload to stop at its deadline, took %v", elapsed)
+	}
+	if _, err = os.Stat(f.Name()); err != nil {
+		t.Errorf("Expected %s to be kept after a failed upload: %v", f.Name(), err)
+	}
+}
+
+func TestUploaderChecksums(t *testing.T) {
+	fn := writeTempFile(t, "hello world")
+	defer os.Remove(fn)
+
+	s3Uploader := &recordingS3Uploader{}
+	u := NewFactory("bucket", &simpleNameGenerator{prefix: "test"}, s3Uploader,
+		WithChecksums(ChecksumMD5|ChecksumSHA256)).NewUploader()
+	receipt, err := u.Upload(&UploadRequest{Filename: fn, FileType: Text})
+	if err != nil {
+		t.Fatalf("Failed to upload %s: %v", fn, err)
+	}
+	if receipt.UploadedAt.IsZero() {
+		t.Errorf("Expected the receipt to say when the upload finished")
+	}
+	receipt.UploadedAt = time.Time{}
+
+	expected := &UploadReceipt{
+		Path:        fn,
+		KeyName:     "bucket/test/" + fn,
+		Size:        11,
+		RawSize:     11,
+		MD5:         "5eb63bbbe01eeed093cb22bb8f5acdc3",
+		SHA256:      "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9",
+		ETag:        "5eb63bbbe01eeed093cb22bb8f5acdc3",
+		VersionID:   "v1",
+		ContentType: Text,
+		Attempts:    1,
+		Written:     true,
+		Metadata: map[string]string{
+			MD5MetadataKey:    "5eb63bbbe01eeed093cb22bb8f5acdc3",
+			SHA256MetadataKey: "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9",
+		},
+	}
+	if !reflect.DeepEqual(receipt, expected) {
+		t.Errorf("Expected receipt %+v, got %+v", expected, receipt)
+	}
+	input := s3Uploader.inputs[0]
+	if md5sum := aws.StringValue(input.ContentMD5); md5sum != "XrY7u+Ae7tCTyyK7j1rNww==" {
+		t.Errorf("Expected Content-MD5 XrY7u+Ae7tCTyyK7j1rNww==, got %s", md5sum)
+	}
+	if sha256sum := aws.StringValue(input.Metadata[SHA256MetadataKey]); sha256sum != expected.SHA256 {
+		t.Errorf("Expected sha256 metadata %s, got %s", expected.SHA256, sha256sum)
+	}
+	if body := string(s3Uploader.bodies[0]); body != "hello world" {
+		t.Errorf("Expected to upload %q, got %q", "hello world", body)
+	}
+}
+
+func TestUploaderChecksumMismatch(t *testing.T) {
+	defer noBackoff()()
+	fn := writeTempFile(t, "hello world")
+	defer os.Remove(fn)
+
+	s3Uploader := &recordingS3Uploader{etag: "00000000000000000000000000000000"}
+	u := NewFactory("bucket", &simpleNameGenerator{prefix: "test"}, s3Uploader).NewUploader()
+	_, err := u.Upload(&UploadRequest{Filename: fn, FileType: Text})
+	var mismatch *ChecksumMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Errorf("Expected a ChecksumMismatchError, got %v", err)
+	}
+	attempts := DefaultRetryPolicy.MaxAttempts
+	if len(s3Uploader.inputs) != attempts {
+		t.Errorf("Expected a mismatch to be retried %d times, got %d", attempts, len(s3Uploader.inputs))
+	}
+	if retryErr, ok := err.(*RetryError); !ok || retryErr.Attempts != attempts {
+		t.Errorf("Expected a RetryError after %d attempts, got %#v", attempts, err)
+	}
+}
+
+func TestUploaderObjectOptions(t *testing.T) {
+	fn := writeTempFile(t, "hello world")
+	defer os.Remove(fn)
+
+	// With SSE-KMS the ETag isn't an MD5, so it mustn't be compared.
+	s3Uploader := &recordingS3Uploader{etag: "00000000000000000000000000000000"}
+	u := NewFactory("bucket", &simpleNameGenerator{prefix: "test"}, s3Uploader,
+		WithSSEKMS("key-id"),
+		WithStorageClass(s3.StorageClassStandardIa),
+		WithCacheControl("no-cache"),
+	).NewUploader()
+	_, err := u.Upload(&UploadRequest{
+		Filename:      fn,
+		FileType:      Text,
+		ObjectOptions: &ObjectOptions{StorageClass: s3.StorageClassGlacier},
+	})
+	if err != nil {
+		t.Fatalf("Failed to upload %s: %v", fn, err)
+	}
+
+	input := s3Uploader.inputs[0]
+	actual := map[string]*string{
+		"ACL":                  input.ACL,
+		"ServerSideEncryption": input.ServerSideEncryption,
+		"SSEKMSKeyId":          input.SSEKMSKeyId,
+		"StorageClass":         input.StorageClass,
+		"CacheControl":         input.CacheControl,
+	}
+	for field, value := range map[string]string{
+		"ACL":                  s3.ObjectCannedACLBucketOwnerFullControl,
+		"ServerSideEncryption": s3.ServerSideEncryptionAwsKms,
+		"SSEKMSKeyId":          "key-id",
+		"StorageClass":         s3.StorageClassGlacier,
+		"CacheControl":         "no-cache",
+	} {
+		if v := aws.StringValue(actual[field]); v != value {
+			t.Errorf("Expected %s to be %q, got %q", field, value, v)
+		}
+	}
+	if input.ContentEncoding != nil {
+		t.Errorf("Expected no ContentEncoding, got %q", aws.StringValue(input.ContentEncoding))
+	}
+}
+
+func TestUploaderMetadataAndTags(t *testing.T) {
+	fn := writeTempFile(t, "hello world")
+	defer os.Remove(fn)
+
+	s3Uploader := &recordingS3Uploader{}
+	u := NewFactory("bucket", &simpleNameGenerator{prefix: "test"}, s3Uploader).NewUploader()
+	receipt, err := u.Upload(&UploadRequest{
+		Filename: fn,
+		FileType: Text,
+		Metadata: map[string]string{"Producer": "test", MetadataRecordCount: "1"},
+		Tags:     map[string]string{"retention": "short"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to upload %s: %v", fn, err)
+	}
+
+	expectedMetadata := map[string]string{
+		MetadataProducer:    "test",
+		MetadataRecordCount: "1",
+		MD5MetadataKey:      "5eb63bbbe01eeed093cb22bb8f5acdc3",
+	}
+	if !reflect.DeepEqual(receipt.Metadata, expectedMetadata) {
+		t.Errorf("Expected receipt metadata %v, got %v", expectedMetadata, receipt.Metadata)
+	}
+	if !reflect.DeepEqual(aws.StringValueMap(s3Uploader.inputs[0].Metadata), expectedMetadata) {
+		t.Errorf("Expected to upload metadata %v, got %v", expectedMetadata,
+			aws.StringValueMap(s3Uploader.inputs[0].Metadata))
+	}
+	if tagging := aws.StringValue(s3Uploader.inputs[0].Tagging); tagging != "retention=short" {
+		t.Errorf("Expected tagging retention=short, got %s", tagging)
+	}
+	if receipt.Tags["retention"] != "short" {
+		t.Errorf("Expected receipt to echo tags, got %v", receipt.Tags)
+	}
+
+	// Invalid tags and metadata are rejected before anything is sent, and
+	// the file isn't disposed of. The metadata leaves no room for the MD5.
+	fn = writeTempFile(t, "hello world")
+	defer os.Remove(fn)
+	for _, req := range []*UploadRequest{
+		{Filename: fn, FileType: Text, Tags: map[string]string{"aws:reserved": "v"}},
+		{Filename: fn, FileType: Text, Metadata: map[string]string{"k": strings.Repeat("v", maxMetadataBytes-1)}},
+	} {
+		if _, err = u.Upload(req); err == nil {
+			t.Errorf("Expected an error for invalid request %+v", req)
+		}
+		if _, err = os.Stat(fn); err != nil {
+			t.Errorf("Expected %s to be kept, got %v", fn, err)
+		}
+	}
+	if len(s3Uploader.inputs) != 1 {
+		t.Errorf("Expected invalid upload not to be sent, got %d uploads", len(s3Uploader.inputs))
+	}
+}
+
+func TestUploaderCompression(t *testing.T) {
+	contents := strings.Repeat("hello world\n", 1000)
+	decompressors := map[Compression]func([]byte) ([]byte, error){
+		GzipCompression: func(b []byte) ([]byte, error) {
+			r, err := gzip.NewReader(bytes.NewReader(b))
+			if err != nil {
+				return nil, err
+			}
+			return ioutil.ReadAll(r)
+		},
+		ZstdCompression: func(b []byte) ([]byte, error) {
+			r, err := zstd.NewReader(bytes.NewReader(b))
+			if err != nil {
+				return nil, err
+			}
+			defer r.Close()
+			return ioutil.ReadAll(r)
+		},
+	}
+	for compression, decompress := range decompressors {
+		fn := writeTempFile(t, contents)
+		defer os.Remove(fn)
+
+		s3Uploader := &recordingS3Uploader{}
+		u := NewFactory("bucket", &simpleNameGenerator{prefix: "test"}, s3Uploader,
+			WithCompression(compression)).NewUploader()
+		receipt, err := u.Upload(&UploadRequest{Filename: fn, FileType: Text})
+		if err != nil {
+			t.Fatalf("Failed to upload %s with %s: %v", fn, compression, err)
+		}
+
+		body := s3Uploader.bodies[0]
+		decompressed, err := decompress(body)
+		if err != nil || string(decompressed) != contents {
+			t.Errorf("Expected %s body to decompress to the file contents, got error %v", compression, err)
+		}
+		input := s3Uploader.inputs[0]
+		if key := aws.StringValue(input.Key); key != "test/"+fn+compression.extension() {
+			t.Errorf("Expected key test/%s%s, got %s", fn, compression.extension(), key)
+		}
+		if contentType := aws.StringValue(input.ContentType); contentType != string(compression.fileType()) {
+			t.Errorf("Expected Content-Type %s, got %s", compression.fileType(), contentType)
+		}
+		if encoding := aws.StringValue(input.ContentEncoding); encoding != string(compression) {
+			t.Errorf("Expected Content-Encoding %s, got %s", compression, encoding)
+		}
+		if input.ContentMD5 != nil {
+			t.Errorf("Expected no Content-MD5 for a compressed upload")
+		}
+		sum := md5.Sum(body)
+		if receipt.MD5 != hex.EncodeToString(sum[:]) {
+			t.Errorf("Expected receipt MD5 to be of the %s data, got %s", compression, receipt.MD5)
+		}
+		if receipt.Size != int64(len(body)) || receipt.RawSize != int64(len(contents)) {
+			t.Errorf("Expected sizes %d and %d, got %d and %d",
+				len(body), len(contents), receipt.Size, receipt.RawSize)
+		}
+	}
+}
+
+func TestUploaderUnknownCompression(t *testing.T) {
+	fn := writeTempFile(t, "hello world")
+	defer os.Remove(fn)
+
+	s3Uploader := &recordingS3Uploader{}
+	u := NewFactory("bucket", &simpleNameGenerator{prefix: "test"}, s3Uploader).NewUploader()
+	if _, err := u.Upload(&UploadRequest{Filename: fn, FileType: Text, Compression: "lz4"}); err == nil {
+		t.Error("Expected an error for an unknown compression")
+	}
+	if len(s3Uploader.inputs) != 0 {
+		t.Errorf("Expected nothing to be uploaded, got %d uploads", len(s3Uploader.inputs))
+	}
+	if _, err := os.Stat(fn); err != nil {
+		t.Errorf("Expected %s to be kept, got %v", fn, err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected WithCompression to panic for an unknown compression")
+		}
+	}()
+	WithCompression("lz4")
+}
+
+// onlyReader hides any methods of its Reader other than Read.
+type onlyReader struct {
+	r *strings.Reader
+}
+
+func (o *onlyReader) Read(p []byte) (int, error) { return o.r.Read(p) }
+
+func TestUploaderEmptyData(t *testing.T) {
+	// A local file with the same name must be neither uploaded nor removed.
+	fn := writeTempFile(t, "local file")
+	defer os.Remove(fn)
+
+	for _, data := range [][]byte{nil, {}} {
+		s3Uploader := &recordingS3Uploader{}
+		u := NewFactory("bucket", &simpleNameGenerator{prefix: "mem"}, s3Uploader).NewUploader()
+		receipt, err := u.Upload(NewDataRequest(fn, data, Text))
+		if err != nil {
+			t.Fatalf("Failed to upload empty data: %v", err)
+		}
+		if len(s3Uploader.bodies[0]) != 0 || receipt.RawSize != 0 {
+			t.Errorf("expected an empty object but uploaded %q", s3Uploader.bodies[0])
+		}
+		if _, err = os.Stat(fn); err != nil {
+			t.Errorf("expected %s to be left alone but got %v", fn, err)
+		}
+	}
+}
+
+func TestUploaderInMemory(t *testing.T) {
+	defer noBackoff()()
+
+	var disposed []string
+	disposer := DisposerFunc(func(req *UploadRequest, _ error) error {
+		disposed = append(disposed, req.Filename)
+		return nil
+	})
+	seeker := strings.NewReader("seekable data")
+	seeker.Seek(4, 0)
+	for _, tc := range []struct {
+		req  *UploadRequest
+		body string
+	}{
+		{req: NewDataRequest("data.txt", []byte("some data"), Text), body: "some data"},
+		{req: NewReaderRequest("seeker.txt", seeker, Text), body: "seekable data"},
+		{req: NewReaderRequest("reader.txt", &onlyReader{strings.NewReader("streamed data")}, Text), body: "streamed data"},
+	} {
+		// A bad ETag makes every attempt fail, so the body must be read
+		// afresh for each retry.
+		s3Uploader := &recordingS3Uploader{etag: "00000000000000000000000000000000"}
+		u := NewFactory("bucket", &simpleNameGenerator{prefix: "mem"}, s3Uploader, WithDisposer(disposer)).NewUploader()
+		if _, err := u.Upload(tc.req); err == nil {
+			t.Errorf("%s: expected a checksum mismatch", tc.req.Filename)
+		}
+		if len(s3Uploader.bodies) != DefaultRetryPolicy.MaxAttempts {
+			t.Fatalf("%s: expected %d attempts but got %d", tc.req.Filename, DefaultRetryPolicy.MaxAttempts, len(s3Uploader.bodies))
+		}
+		for _, body := range s3Uploader.bodies {
+			if string(body) != tc.body {
+				t.Errorf("%s: expected to upload %q but got %q", tc.req.Filename, tc.body, body)
+			}
+		}
+		if key := aws.StringValue(s3Uploader.inputs[0].Key); key != "mem/"+tc.req.Filename {
+			t.Errorf("expected key mem/%s but got %s", tc.req.Filename, key)
+		}
+	}
+
+	s3Uploader := &recordingS3Uploader{}
+	u := NewFactory("bucket", &simpleNameGenerator{prefix: "mem"}, s3Uploader, WithDisposer(disposer)).NewUploader()
+	receipt, err := u.Upload(NewDataRequest("data.txt", []byte("some data"), Text))
+	if err != nil {
+		t.Fatalf("Failed to upload data: %v", err)
+	}
+	if receipt.Path != "data.txt" || receipt.KeyName != "bucket/mem/data.txt" || receipt.RawSize != 9 {
+		t.Errorf("unexpected receipt %+v", receipt)
+	}
+	if len(disposed) != 0 {
+		t.Errorf("expected nothing to be disposed of but got %v", disposed)
+	}
+}
+
+func TestUploaderS3Mock(t *testing.T) {
+	defer noBackoff()()
+	small := writeTempFile(t, "hello world")
+	defer os.Remove(small)
+	// Big enough for s3manager to upload it in three parts.
+	large := writeTempFile(t, strings.Repeat("0123456789", 1200000))
+	defer os.Remove(large)
+
+	bucket := mocks.NewS3("bucket")
+	failed := map[string]bool{}
+	bucket.Fault = func(op, _, key string) error {
+		// Fail the first single part upload and the first part of the first
+		// multipart upload.
+		if (op == "PutObject" || op == "UploadPart") && !failed[op] {
+			failed[op] = true
+			return awserr.NewRequestFailure(awserr.New("InternalError", "oops", nil), 500, "")
+		}
+		return nil
+	}
+	u := NewFactory("bucket", &simpleNameGenerator{prefix: "test"}, s3manager.NewUploaderWithClient(bucket, func(u *s3manager.Uploader) {
+		u.Concurrency = 1
+	}), WithChecksums(ChecksumMD5), WithDisposer(Keep)).NewUploader()
+
+	for _, fn := range []string{small, large} {
+		receipt, err := u.Upload(&UploadRequest{Filename: fn, FileType: Text})
+		if err != nil {
+			t.Fatalf("Failed to upload %s: %v", fn, err)
+		}
+		contents, _ := ioutil.ReadFile(fn)
+		object, ok := bucket.Object("bucket", "test/"+fn)
+		if !ok {
+			t.Fatalf("Expected %s to be uploaded to test/%s, got %v", fn, fn, bucket.Keys("bucket"))
+		}
+		if !bytes.Equal(object.Body, contents) {
+			t.Errorf("Expected the object to contain %s", fn)
+		}
+		if receipt.Attempts != 2 {
+			t.Errorf("Expected the upload of %s to take 2 attempts, got %d", fn, receipt.Attempts)
+		}
+		if md5sum := object.Metadata[MD5MetadataKey]; md5sum != receipt.MD5 {
+			t.Errorf("Expected md5 metadata %s, got %s", receipt.MD5, md5sum)
+		}
+		if etag := strings.Trim(object.ETag, `"`); etag != receipt.ETag {
+			t.Errorf("Expected receipt ETag %s, got %s", etag, receipt.ETag)
+		}
+	}
+	if object, _ := bucket.Object("bucket", "test/"+large); object.PartsUploaded != 3 || !strings.HasSuffix(object.ETag, `-3"`) {
+		t.Errorf("Expected a 3 part upload, got %d parts with ETag %s", object.PartsUploaded, object.ETag)
+	}
+	if n := bucket.Uploads(); n != 0 {
+		t.Errorf("Expected failed multipart uploads to be aborted, %d left", n)
+	}
+
+	// An identical object is skipped.
+	u = NewFactory("bucket", &simpleNameGenerator{prefix: "test"}, s3manager.NewUploaderWithClient(bucket),
+		WithChecksums(ChecksumMD5), WithSkipIdentical(bucket, FailMismatched)).NewUploader()
+	puts := bucket.Calls("PutObject")
+	receipt, err := u.Upload(&UploadRequest{Filename: small, FileType: Text})
+	if err != nil {
+		t.Fatalf("Failed to upload %s: %v", small, err)
+	}
+	if receipt.Written || bucket.Calls("PutObject") != puts {
+		t.Errorf("Expected the identical object to be skipped")
+	}
+}